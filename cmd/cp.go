@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/findardi/goscp-lite/internal"
+	"github.com/spf13/cobra"
+)
+
+var cpCmd = &cobra.Command{
+	Use:     "cp",
+	Aliases: []string{"c"},
+	Short:   "Copy files to or from a remote server using scp-style paths",
+	Long:    "Copy a file or directory between local machine and remote server.\nThe side written as [user@]host[:port]:path is remote, the direction is inferred.\n\nArguments:\n  <src>  Source path, local or [user@]host[:port]:path\n  <dst>  Destination path, local or [user@]host[:port]:path",
+	Example: "  goscp cp ./file.txt admin@example.com:2222:/remote/path/\n  goscp cp 'admin@[2001:db8::1]:/var/log/app.log' ./logs/",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		internal.Copy(opts, args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+}
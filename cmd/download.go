@@ -10,10 +10,10 @@ var downloadCmd = &cobra.Command{
 	Aliases: []string{"d"},
 	Short:   "Download file from remote server via SFTP",
 	Long:    "Download a remote file to local machine using SFTP protocol.\n\nArguments:\n  <remote-path>  Path to file on remote server\n  <local-path>   Destination path on local machine",
-	Example: "  goscp download /remote/file.txt ./local/path/ -H example.com -p 123",
+	Example: "  goscp download /remote/file.txt ./local/path/ -H example.com -p 123\n  goscp download admin@example.com:/remote/file.txt ./local/path/",
 	Args:    cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		internal.Download(user, host, port, keypath, args[1], args[0], retry)
+		internal.Download(opts, args[1], args[0])
 	},
 }
 
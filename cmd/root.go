@@ -4,16 +4,11 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/findardi/goscp-lite/internal"
 	"github.com/spf13/cobra"
 )
 
-var (
-	user    string
-	keypath string
-	host    string
-	port    int
-	retry   int
-)
+var opts internal.Options
 
 var rootCmd = &cobra.Command{
 	Use:   "goscp",
@@ -23,14 +18,49 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
-	rootCmd.PersistentFlags().IntVarP(&retry, "retry", "r", 3, "Max retry attempts on failure")
-
-	rootCmd.PersistentFlags().StringVarP(&host, "host", "H", "", "host server")
-	rootCmd.PersistentFlags().IntVarP(&port, "port", "p", 22, "port server")
-	rootCmd.PersistentFlags().StringVarP(&user, "user", "U", "", "SSH username (default:root)")
-	rootCmd.PersistentFlags().StringVarP(&keypath, "key", "k", "", "Path to private key (default:auto-detect)")
+	rootCmd.PersistentFlags().IntVarP(&opts.Retry, "retry", "r", 3, "Max retry attempts on failure")
+	rootCmd.PersistentFlags().IntVar(&opts.Connections, "connections", internal.DefaultConnections, "Number of SSH connections used for parallel transfers")
+	rootCmd.PersistentFlags().IntVar(&opts.Sessions, "sessions", internal.DefaultSessions, "Number of SFTP sessions opened on each connection")
+	rootCmd.PersistentFlags().IntVar(&opts.Stripes, "stripes", 0, "Split large files into byte ranges transferred over this many connections")
+	rootCmd.PersistentFlags().StringVar(&opts.Verify, "verify", internal.VerifyAuto, "Integrity check: auto, remote, readback or none")
+	rootCmd.PersistentFlags().StringVar(&opts.Checksum, "checksum", "", "Checksum algorithm: md5, sha1, sha256, sha512, blake2b or xxh64 (default:sha256, or md5 if that is all the server has)")
+	rootCmd.PersistentFlags().BoolVar(&opts.VerifyResume, "verify-resume", false, "Read back every completed block of the remote .part file before resuming an upload")
+	rootCmd.PersistentFlags().BoolVar(&opts.Preserve, "preserve", false, "Preserve mode bits and access/modification times")
+	rootCmd.PersistentFlags().BoolVar(&opts.PreserveOwner, "owner", false, "Also preserve owner and group, mapped by name (implies --preserve)")
+	rootCmd.PersistentFlags().BoolVar(&opts.NumericIDs, "numeric-ids", false, "With --owner, keep numeric uid/gid instead of mapping names")
+	rootCmd.PersistentFlags().StringVar(&opts.Links, "links", internal.LinksCopy, "Symbolic links in directories: copy, follow, skip or preserve")
+	rootCmd.PersistentFlags().BoolVar(&opts.Sparse, "sparse", false, "Leave holes for runs of zeros instead of writing them")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.Include, "include", nil, "Always copy entries of a directory matching this pattern (** allowed)")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.Exclude, "exclude", nil, "Skip entries of a directory matching this pattern (** allowed)")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.ExcludeFrom, "exclude-from", nil, "Read exclude patterns from file, one per line")
+	rootCmd.PersistentFlags().BoolVar(&opts.IgnoreFiles, "ignore-files", false, "Honour .gitignore and .goscpignore files in copied directories")
+	rootCmd.PersistentFlags().IntVar(&opts.Workers, "workers", 0, "Concurrent writes per file (default:auto)")
+	rootCmd.PersistentFlags().IntVar(&opts.BufferSize, "buffer-size", 0, "Bytes read at once from the source (default:auto)")
+	rootCmd.PersistentFlags().IntVar(&opts.PacketSize, "packet-size", 0, "Bytes per SFTP read or write request (default:server limit or 32768)")
+	rootCmd.PersistentFlags().IntVar(&opts.Requests, "requests", 0, "SFTP requests in flight per read or write call (default:64)")
 
-	rootCmd.MarkFlagRequired("host")
+	rootCmd.PersistentFlags().StringVarP(&opts.Host, "host", "H", "", "host server")
+	rootCmd.PersistentFlags().IntVarP(&opts.Port, "port", "p", 0, "port server (default:22)")
+	rootCmd.PersistentFlags().StringVarP(&opts.User, "user", "U", "", "SSH username (default:root)")
+	rootCmd.PersistentFlags().StringVarP(&opts.KeyPath, "key", "k", "", "Path to private key (default:auto-detect)")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.CertificateFiles, "cert", nil, "Path to SSH user certificate (default:<key>-cert.pub)")
+	rootCmd.PersistentFlags().StringVar(&opts.PassphraseFile, "passphrase-file", "", "Read private key passphrase from file (or set GOSCP_PASSPHRASE)")
+	rootCmd.PersistentFlags().BoolVar(&opts.PasswordStdin, "password-stdin", false, "Read SSH password from stdin (or set GOSCP_PASSWORD)")
+	rootCmd.PersistentFlags().StringSliceVar(&opts.AuthOrder, "auth-order", internal.DefaultAuthOrder, "Preferred order of authentication methods")
+	rootCmd.PersistentFlags().StringVarP(&opts.ProxyJump, "jump", "J", "", "Jump hosts, comma separated [user@]host[:port] (ssh_config ProxyJump)")
+	rootCmd.PersistentFlags().StringVar(&opts.Proxy, "proxy", "", "Proxy url, socks5://[user:pass@]host:port or http://[user:pass@]host:port")
+	rootCmd.PersistentFlags().StringVar(&opts.ProxyCommand, "proxy-command", "", "Command whose stdio is used as connection, %h and %p expand to host and port")
+	rootCmd.PersistentFlags().StringVar(&opts.StrictHostKeyChecking, "strict-host-key-checking", "", "Unknown host keys: yes, no, accept-new or ask (default:ask)")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.KnownHostsFiles, "known-hosts", nil, "Known hosts file to read and update (default:~/.ssh/known_hosts)")
+	rootCmd.PersistentFlags().StringSliceVar(&opts.HostKeyFingerprints, "host-key-fingerprint", nil, "Only accept a host key with this SHA256 fingerprint")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.HostCAFiles, "host-ca", nil, "Public key of a CA trusted to sign host certificates")
+	rootCmd.PersistentFlags().BoolVar(&opts.HashKnownHosts, "hash-known-hosts", false, "Hash host names of new known_hosts entries")
+	rootCmd.PersistentFlags().StringVar(&opts.CryptoProfile, "crypto-profile", "", "Algorithm profile: modern, compat or fips (default:modern)")
+	rootCmd.PersistentFlags().StringVar(&opts.Ciphers, "ciphers", "", "Ciphers, comma separated; prefix +, - or ^ to append, remove or prepend")
+	rootCmd.PersistentFlags().StringVar(&opts.MACs, "macs", "", "MAC algorithms, comma separated; prefix +, - or ^ to append, remove or prepend")
+	rootCmd.PersistentFlags().StringVar(&opts.KexAlgorithms, "kex", "", "Key exchange algorithms, comma separated; prefix +, - or ^ to append, remove or prepend")
+	rootCmd.PersistentFlags().StringVar(&opts.HostKeyAlgorithms, "host-key-algorithms", "", "Host key algorithms, comma separated; prefix +, - or ^ to append, remove or prepend")
+	rootCmd.PersistentFlags().StringVarP(&opts.SSHConfigFile, "ssh-config", "F", "", "Path to ssh_config file, 'none' to disable (default:~/.ssh/config)")
 }
 
 func Execute() {
@@ -5,6 +5,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var showAlgorithms bool
+
 var testCmd = &cobra.Command{
 	Use:     "test",
 	Aliases: []string{"t"},
@@ -13,10 +15,11 @@ var testCmd = &cobra.Command{
 	Example: "goscp test -H example.com -p 123 -u admin",
 	Args:    cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		internal.Test(user, host, keypath, port)
+		internal.Test(opts, showAlgorithms)
 	},
 }
 
 func init() {
+	testCmd.Flags().BoolVar(&showAlgorithms, "show-algorithms", false, "Show the negotiated key exchange, host key, cipher and MAC")
 	rootCmd.AddCommand(testCmd)
 }
@@ -3,10 +3,15 @@ module github.com/findardi/goscp-lite
 go 1.25.3
 
 require (
+	github.com/bmatcuk/doublestar/v4 v4.10.2
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/pkg/sftp v1.13.10
 	github.com/schollz/progressbar/v3 v3.18.0
 	github.com/spf13/cobra v1.10.2
 	golang.org/x/crypto v0.46.0
+	golang.org/x/net v0.48.0
+	golang.org/x/sys v0.39.0
+	golang.org/x/term v0.38.0
 )
 
 require (
@@ -15,6 +20,4 @@ require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/spf13/pflag v1.0.10 // indirect
-	golang.org/x/sys v0.39.0 // indirect
-	golang.org/x/term v0.38.0 // indirect
 )
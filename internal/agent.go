@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var ErrNoAgent = errors.New("ssh-agent not available (SSH_AUTH_SOCK is not set)")
+
+type Agent struct {
+	agent.ExtendedAgent
+	conn net.Conn
+}
+
+// DialAgent connects to the ssh-agent listening on the given unix socket.
+// The connection stays open until Close, signing requests go through it.
+func DialAgent(socket string) (*Agent, error) {
+	if socket == "" {
+		return nil, ErrNoAgent
+	}
+
+	conn, err := net.DialTimeout("unix", socket, defaultConnTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to ssh-agent: %w", err)
+	}
+
+	return &Agent{
+		ExtendedAgent: agent.NewClient(conn),
+		conn:          conn,
+	}, nil
+}
+
+func AgentFromEnv() (*Agent, error) {
+	return DialAgent(os.Getenv("SSH_AUTH_SOCK"))
+}
+
+func (a *Agent) Close() error {
+	return a.conn.Close()
+}
+
+func (a *Agent) SignerSource() SignerSource {
+	return func() ([]ssh.Signer, error) {
+		signers, err := a.Signers()
+		if err != nil {
+			return nil, fmt.Errorf("ssh-agent: %w", err)
+		}
+		return signers, nil
+	}
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeTestKey stores key as an OpenSSH private key file and its .pub.
+func writeTestKey(t *testing.T, dir, name string, key ed25519.PrivateKey) string {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveTestAgent serves an in-process keyring holding keys, in order, on
+// a unix socket named by SSH_AUTH_SOCK.
+func serveTestAgent(t *testing.T, keys ...ed25519.PrivateKey) {
+	t.Helper()
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+}
+
+func TestKeySourcesAgent(t *testing.T) {
+	k1, k2, k3 := newTestKey(t), newTestKey(t), newTestKey(t)
+	dir := t.TempDir()
+	k1Path := writeTestKey(t, dir, "id_k1", k1)
+	k2Path := writeTestKey(t, dir, "id_k2", k2)
+	// the agent holds k2, but its private key file is gone
+	os.Remove(k2Path)
+
+	serveTestAgent(t, k3, k1, k2)
+	// no default keys from the real home directory
+	t.Setenv("HOME", t.TempDir())
+
+	tests := []struct {
+		name string
+		opts Options
+		want []ed25519.PrivateKey
+	}{
+		{
+			name: "key file first, then agent in its order without duplicates",
+			opts: Options{KeyPath: k1Path},
+			want: []ed25519.PrivateKey{k1, k3, k2},
+		},
+		{
+			name: "IdentitiesOnly keeps agent keys of configured identities",
+			opts: Options{IdentityFiles: []string{k1Path, k2Path}, IdentitiesOnly: true},
+			want: []ed25519.PrivateKey{k1, k2},
+		},
+		{
+			name: "IdentitiesOnly drops agent keys that are not configured",
+			opts: Options{KeyPath: k1Path, IdentitiesOnly: true},
+			want: []ed25519.PrivateKey{k1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unlocker, err := newKeyUnlocker("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ag, err := AgentFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ag.Close()
+
+			sources, _, err := keySources(tt.opts, unlocker, ag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signers, err := chainSigners(sources...)()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(signers) != len(tt.want) {
+				t.Fatalf("got %d signers, want %d", len(signers), len(tt.want))
+			}
+			for i, key := range tt.want {
+				want, _ := ssh.NewPublicKey(key.Public())
+				if !bytes.Equal(signers[i].PublicKey().Marshal(), want.Marshal()) {
+					t.Errorf("signer %d is %s, want %s", i, ssh.FingerprintSHA256(signers[i].PublicKey()), ssh.FingerprintSHA256(want))
+				}
+			}
+		})
+	}
+}
+
+func TestAgentFromEnvUnset(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := AgentFromEnv(); !errors.Is(err, ErrNoAgent) {
+		t.Fatalf("got %v, want ErrNoAgent", err)
+	}
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	ProfileModern = "modern"
+	ProfileCompat = "compat"
+	ProfileFIPS   = "fips"
+)
+
+// algorithmProfiles are the named starting points for --crypto-profile.
+// modern is the default; compat adds legacy algorithms still found on old
+// servers, fips keeps only FIPS 140 approved ones.
+var algorithmProfiles = map[string]ssh.Algorithms{
+	ProfileModern: {
+		Ciphers: []string{
+			ssh.CipherChaCha20Poly1305,
+			ssh.CipherAES128GCM,
+			ssh.CipherAES256GCM,
+			ssh.CipherAES128CTR,
+			ssh.CipherAES192CTR,
+			ssh.CipherAES256CTR,
+		},
+		MACs: []string{
+			ssh.HMACSHA256ETM,
+			ssh.HMACSHA512ETM,
+			ssh.HMACSHA256,
+			ssh.HMACSHA512,
+		},
+		KeyExchanges: []string{
+			ssh.KeyExchangeMLKEM768X25519,
+			ssh.KeyExchangeCurve25519,
+			ssh.KeyExchangeECDHP256,
+			ssh.KeyExchangeECDHP384,
+			ssh.KeyExchangeECDHP521,
+			ssh.KeyExchangeDH16SHA512,
+			ssh.KeyExchangeDH14SHA256,
+		},
+		HostKeys: ssh.SupportedAlgorithms().HostKeys,
+	},
+	ProfileCompat: {
+		Ciphers: []string{
+			ssh.CipherChaCha20Poly1305,
+			ssh.CipherAES128GCM,
+			ssh.CipherAES256GCM,
+			ssh.CipherAES128CTR,
+			ssh.CipherAES192CTR,
+			ssh.CipherAES256CTR,
+			ssh.InsecureCipherAES128CBC,
+			ssh.InsecureCipherTripleDESCBC,
+		},
+		MACs: []string{
+			ssh.HMACSHA256ETM,
+			ssh.HMACSHA512ETM,
+			ssh.HMACSHA256,
+			ssh.HMACSHA512,
+			ssh.HMACSHA1,
+			ssh.InsecureHMACSHA196,
+		},
+		KeyExchanges: []string{
+			ssh.KeyExchangeMLKEM768X25519,
+			ssh.KeyExchangeCurve25519,
+			ssh.KeyExchangeECDHP256,
+			ssh.KeyExchangeECDHP384,
+			ssh.KeyExchangeECDHP521,
+			ssh.KeyExchangeDH16SHA512,
+			ssh.KeyExchangeDH14SHA256,
+			ssh.KeyExchangeDHGEXSHA256,
+			ssh.InsecureKeyExchangeDH14SHA1,
+			ssh.InsecureKeyExchangeDHGEXSHA1,
+			ssh.InsecureKeyExchangeDH1SHA1,
+		},
+		HostKeys: append(ssh.SupportedAlgorithms().HostKeys,
+			ssh.CertAlgoRSAv01,
+			ssh.KeyAlgoRSA,
+			ssh.InsecureKeyAlgoDSA,
+		),
+	},
+	ProfileFIPS: {
+		Ciphers: []string{
+			ssh.CipherAES256GCM,
+			ssh.CipherAES128GCM,
+			ssh.CipherAES256CTR,
+			ssh.CipherAES192CTR,
+			ssh.CipherAES128CTR,
+		},
+		MACs: []string{
+			ssh.HMACSHA256ETM,
+			ssh.HMACSHA512ETM,
+			ssh.HMACSHA256,
+			ssh.HMACSHA512,
+		},
+		KeyExchanges: []string{
+			ssh.KeyExchangeECDHP256,
+			ssh.KeyExchangeECDHP384,
+			ssh.KeyExchangeECDHP521,
+			ssh.KeyExchangeDH16SHA512,
+			ssh.KeyExchangeDH14SHA256,
+		},
+		HostKeys: []string{
+			ssh.CertAlgoECDSA256v01,
+			ssh.CertAlgoECDSA384v01,
+			ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA256v01,
+			ssh.CertAlgoRSASHA512v01,
+			ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoECDSA384,
+			ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA256,
+			ssh.KeyAlgoRSASHA512,
+		},
+	},
+}
+
+// AlgorithmSpec is the user's choice of algorithms: a profile plus one
+// OpenSSH style list per kind, each either a replacement list or a list
+// prefixed with '+' (append), '-' (remove, wildcards allowed) or '^'
+// (prepend) applied to the profile.
+type AlgorithmSpec struct {
+	Profile      string
+	Ciphers      string
+	MACs         string
+	KeyExchanges string
+	HostKeys     string
+}
+
+// Resolve returns the algorithms to offer, in preference order.
+func (s AlgorithmSpec) Resolve() (ssh.Algorithms, error) {
+	name := strings.ToLower(s.Profile)
+	if name == "" {
+		name = ProfileModern
+	}
+	profile, ok := algorithmProfiles[name]
+	if !ok {
+		return ssh.Algorithms{}, fmt.Errorf("unknown crypto profile %q (use modern, compat or fips)", s.Profile)
+	}
+
+	supported := ssh.SupportedAlgorithms()
+	insecure := ssh.InsecureAlgorithms()
+
+	var (
+		algos ssh.Algorithms
+		err   error
+	)
+	algos.Ciphers, err = applyAlgorithmList("cipher", profile.Ciphers, s.Ciphers,
+		append(supported.Ciphers, insecure.Ciphers...))
+	if err != nil {
+		return algos, err
+	}
+	algos.MACs, err = applyAlgorithmList("MAC", profile.MACs, s.MACs,
+		append(supported.MACs, insecure.MACs...))
+	if err != nil {
+		return algos, err
+	}
+	algos.KeyExchanges, err = applyAlgorithmList("key exchange", profile.KeyExchanges, s.KeyExchanges,
+		append(supported.KeyExchanges, insecure.KeyExchanges...))
+	if err != nil {
+		return algos, err
+	}
+	algos.HostKeys, err = applyAlgorithmList("host key algorithm", profile.HostKeys, s.HostKeys,
+		append(supported.HostKeys, insecure.HostKeys...))
+	if err != nil {
+		return algos, err
+	}
+	return algos, nil
+}
+
+// applyAlgorithmList applies one OpenSSH style list to the profile's list.
+func applyAlgorithmList(kind string, base []string, spec string, known []string) ([]string, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return slices.Clone(base), nil
+	}
+
+	modifier := spec[0]
+	switch modifier {
+	case '+', '-', '^':
+		spec = spec[1:]
+	default:
+		modifier = 0
+	}
+
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// removals may be patterns, everything else must be implemented
+		if modifier != '-' && !slices.Contains(known, name) {
+			return nil, fmt.Errorf("unsupported %s %q", kind, name)
+		}
+		names = append(names, name)
+	}
+
+	var list []string
+	switch modifier {
+	case '+':
+		list = slices.Clone(base)
+		for _, name := range names {
+			if !slices.Contains(list, name) {
+				list = append(list, name)
+			}
+		}
+	case '^':
+		list = slices.Clone(names)
+		for _, name := range base {
+			if !slices.Contains(list, name) {
+				list = append(list, name)
+			}
+		}
+	case '-':
+		for _, name := range base {
+			if !matchPatternList(names, name) {
+				list = append(list, name)
+			}
+		}
+	default:
+		list = names
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no %s left to offer", kind)
+	}
+	return list, nil
+}
+
+// withoutCertAlgorithms drops the host certificate algorithms, so servers
+// present a key known hosts can hold.
+func withoutCertAlgorithms(algos []string) []string {
+	var plain []string
+	for _, algo := range algos {
+		if !strings.Contains(algo, "-cert-") {
+			plain = append(plain, algo)
+		}
+	}
+	return plain
+}
+
+// NegotiatedAlgorithms returns what client and server agreed on during the
+// last key exchange, if the connection reports it.
+func (c *Client) NegotiatedAlgorithms() (ssh.NegotiatedAlgorithms, bool) {
+	conn, ok := c.Client.Conn.(ssh.AlgorithmsConnMetadata)
+	if !ok {
+		return ssh.NegotiatedAlgorithms{}, false
+	}
+	return conn.Algorithms(), true
+}
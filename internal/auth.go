@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	AuthPublicKey           = "publickey"
+	AuthKeyboardInteractive = "keyboard-interactive"
+	AuthPassword            = "password"
+
+	maxPasswordAttempts = 3
+)
+
+var (
+	DefaultAuthOrder = []string{AuthPublicKey, AuthKeyboardInteractive, AuthPassword}
+
+	ErrNoAuthMethods = errors.New("no usable authentication method")
+)
+
+// authTracker remembers the last method the client attempted. The ssh
+// package tries methods one at a time, so once the handshake succeeds the
+// last attempted method is the one the server accepted.
+type authTracker struct {
+	mu   sync.Mutex
+	last string
+}
+
+func (a *authTracker) record(method string) {
+	a.mu.Lock()
+	a.last = method
+	a.mu.Unlock()
+}
+
+func (a *authTracker) Last() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+// passwordSource answers password and keyboard-interactive challenges,
+// preferring GOSCP_PASSWORD or --password-stdin over a terminal prompt.
+type passwordSource struct {
+	user     string
+	host     string
+	password string
+}
+
+var stdinPassword = sync.OnceValues(func() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("cannot read password from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+})
+
+func newPasswordSource(user, host string, fromStdin bool) (*passwordSource, error) {
+	p := &passwordSource{
+		user:     user,
+		host:     host,
+		password: os.Getenv("GOSCP_PASSWORD"),
+	}
+
+	// stdin is read once and shared by every hop
+	if fromStdin {
+		password, err := stdinPassword()
+		if err != nil {
+			return nil, err
+		}
+		p.password = password
+	}
+
+	return p, nil
+}
+
+func (p *passwordSource) interactive() bool {
+	return p.password == ""
+}
+
+func (p *passwordSource) ask() (string, error) {
+	if !p.interactive() {
+		return p.password, nil
+	}
+
+	secret, err := readSecret(fmt.Sprintf("%s@%s's password: ", p.user, p.host))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func (p *passwordSource) challenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) == 0 {
+		return nil, nil
+	}
+
+	// a lone hidden question is the server asking for the password
+	if len(questions) == 1 && !echos[0] && !p.interactive() {
+		return []string{p.password}, nil
+	}
+
+	if name != "" || instruction != "" {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(name+"\n"+instruction))
+	}
+
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		var (
+			answer []byte
+			err    error
+		)
+		if echos[i] {
+			var line string
+			line, err = readLine(q)
+			answer = []byte(line)
+		} else {
+			answer, err = readSecret(q)
+		}
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = string(answer)
+	}
+	return answers, nil
+}
+
+// keySources gathers the public key identities: an explicit --key first,
+// then IdentityFile entries from ssh_config, then agent identities (with
+// IdentitiesOnly, only those of the configured keys), then the default
+// key files when nothing was configured. Every identity with a matching
+// user certificate is offered with the certificate first; the
+// certificates found are returned as well. ag may be nil.
+func keySources(opts Options, unlocker *keyUnlocker, ag *Agent) ([]SignerSource, []*ssh.Certificate, error) {
+	var (
+		sources []SignerSource
+		// public keys of the configured identities
+		configured []ssh.PublicKey
+	)
+	if opts.KeyPath != "" {
+		keyData, err := os.ReadFile(opts.KeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read key: %w", err)
+		}
+		signer, err := unlocker.loadSigner(opts.KeyPath, keyData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load key: %w", err)
+		}
+		sources = append(sources, StaticSigners(signer))
+		configured = append(configured, signer.PublicKey())
+	}
+
+	for _, path := range opts.IdentityFiles {
+		// the agent may hold a key whose private half is not readable here
+		if pub := readPublicKey(path + ".pub"); pub != nil {
+			configured = append(configured, pub)
+		}
+
+		keyData, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "⚠ Skipping identity file '%s': %v\n", path, err)
+			continue
+		}
+		signer, err := unlocker.loadSigner(path, keyData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "⚠ Skipping identity file '%s': %v\n", path, err)
+			continue
+		}
+		sources = append(sources, StaticSigners(signer))
+		configured = append(configured, signer.PublicKey())
+	}
+
+	if ag != nil {
+		source := ag.SignerSource()
+		if opts.IdentitiesOnly {
+			source = onlyKeys(source, configured)
+		}
+		sources = append(sources, source)
+	}
+
+	keyPaths := append([]string{}, opts.IdentityFiles...)
+	if opts.KeyPath != "" {
+		keyPaths = append([]string{opts.KeyPath}, keyPaths...)
+	}
+
+	if opts.KeyPath == "" && len(opts.IdentityFiles) == 0 {
+		signers := defaultSigners(unlocker)
+		if len(signers) > 0 {
+			sources = append(sources, StaticSigners(signers...))
+		}
+		keyPaths = DefaultKeyPaths()
+	}
+
+	certs := userCertificates(opts.CertificateFiles, keyPaths)
+	for i := range sources {
+		sources[i] = withCertificates(sources[i], certs)
+	}
+
+	return sources, certs, nil
+}
+
+// onlyKeys keeps the signers of source whose public key is one of keys.
+func onlyKeys(source SignerSource, keys []ssh.PublicKey) SignerSource {
+	return func() ([]ssh.Signer, error) {
+		signers, err := source()
+		if err != nil {
+			return nil, err
+		}
+
+		var kept []ssh.Signer
+		for _, signer := range signers {
+			pub := signer.PublicKey().Marshal()
+			for _, key := range keys {
+				if bytes.Equal(pub, key.Marshal()) {
+					kept = append(kept, signer)
+					break
+				}
+			}
+		}
+		return kept, nil
+	}
+}
+
+// authMethods builds the methods in the requested order. The ssh package
+// tries them in slice order, skipping those the server does not allow.
+func authMethods(order []string, sources []SignerSource, pw *passwordSource, tracker *authTracker) ([]ssh.AuthMethod, error) {
+	if len(order) == 0 {
+		order = DefaultAuthOrder
+	}
+
+	tries := 1
+	if pw.interactive() {
+		tries = maxPasswordAttempts
+	}
+
+	var methods []ssh.AuthMethod
+	for _, name := range order {
+		switch strings.TrimSpace(name) {
+		case AuthPublicKey:
+			if len(sources) == 0 {
+				continue
+			}
+			signers := chainSigners(sources...)
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				tracker.record(AuthPublicKey)
+				return signers()
+			}))
+		case AuthKeyboardInteractive:
+			methods = append(methods, ssh.RetryableAuthMethod(
+				ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+					tracker.record(AuthKeyboardInteractive)
+					return pw.challenge(name, instruction, questions, echos)
+				}), tries))
+		case AuthPassword:
+			methods = append(methods, ssh.RetryableAuthMethod(
+				ssh.PasswordCallback(func() (string, error) {
+					tracker.record(AuthPassword)
+					return pw.ask()
+				}), tries))
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", name)
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, ErrNoAuthMethods
+	}
+	return methods, nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate '%s': %w", path, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an SSH certificate", path)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("'%s' is not a user certificate", path)
+	}
+	return cert, nil
+}
+
+// userCertificates loads the explicit --cert / CertificateFile entries and
+// any "<key>-cert.pub" lying next to a candidate key file.
+func userCertificates(explicit, keyPaths []string) []*ssh.Certificate {
+	var certs []*ssh.Certificate
+
+	add := func(path string, required bool) {
+		cert, err := loadCertificate(path)
+		if err != nil {
+			if required || !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "⚠ Skipping certificate: %v\n", err)
+			}
+			return
+		}
+		if problem := certificateProblem(cert, time.Now()); problem != "" {
+			fmt.Fprintf(os.Stderr, "⚠ Certificate '%s' %s\n", path, problem)
+		}
+		certs = append(certs, cert)
+	}
+
+	for _, path := range explicit {
+		add(path, true)
+	}
+	for _, path := range keyPaths {
+		add(path+"-cert.pub", false)
+	}
+	return certs
+}
+
+// certificateProblem describes why cert is outside its validity window at
+// now, or returns "" when it is valid.
+func certificateProblem(cert *ssh.Certificate, now time.Time) string {
+	unix := uint64(now.Unix())
+	switch {
+	case unix < cert.ValidAfter:
+		return fmt.Sprintf("is not valid until %s", certTime(cert.ValidAfter))
+	case cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore:
+		return fmt.Sprintf("expired at %s", certTime(cert.ValidBefore))
+	}
+	return ""
+}
+
+func certTime(t uint64) string {
+	if t == ssh.CertTimeInfinity {
+		return "forever"
+	}
+	return time.Unix(int64(t), 0).Format(time.RFC3339)
+}
+
+// DescribeCertificate renders the key id, principals and validity window.
+func DescribeCertificate(cert *ssh.Certificate) string {
+	principals := strings.Join(cert.ValidPrincipals, ",")
+	if principals == "" {
+		principals = "(any)"
+	}
+
+	validity := fmt.Sprintf("from %s to %s", certTime(cert.ValidAfter), certTime(cert.ValidBefore))
+	if cert.ValidAfter == 0 && cert.ValidBefore == ssh.CertTimeInfinity {
+		validity = "forever"
+	}
+
+	desc := fmt.Sprintf("%s id %q principals %s valid %s", cert.Key.Type(), cert.KeyId, principals, validity)
+	if problem := certificateProblem(cert, time.Now()); problem != "" {
+		desc += " (" + problem + ")"
+	}
+	return desc
+}
+
+// withCertificates offers a certificate signer ahead of every signer whose
+// public key a loaded certificate was issued for.
+func withCertificates(source SignerSource, certs []*ssh.Certificate) SignerSource {
+	if len(certs) == 0 {
+		return source
+	}
+
+	return func() ([]ssh.Signer, error) {
+		signers, err := source()
+		if err != nil {
+			return nil, err
+		}
+
+		var out []ssh.Signer
+		for _, signer := range signers {
+			pub := signer.PublicKey().Marshal()
+			for _, cert := range certs {
+				if !bytes.Equal(cert.Key.Marshal(), pub) {
+					continue
+				}
+				certSigner, err := ssh.NewCertSigner(cert, signer)
+				if err != nil {
+					continue
+				}
+				out = append(out, certSigner)
+			}
+			out = append(out, signer)
+		}
+		return out, nil
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -14,36 +16,81 @@ import (
 
 var (
 	ErrNoClientOption = errors.New("client options not provided")
-	ErrNoSSHClients   = errors.New("no SSH key found in ~/.ssh/ (tried: id_ed25519, id_rsa, id_ecdsa)")
+	ErrNoSSHClients   = errors.New("no SSH key found in ssh-agent or ~/.ssh/ (tried: id_ed25519, id_rsa, id_ecdsa)")
 )
 
+// Dialer opens the transport connection to an SSH server. Both
+// *net.Dialer and *ssh.Client (tunnelling through a jump host) satisfy it.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
 type Client struct {
 	*ssh.Client
-	sftp *sftp.Client
+	sftp   *sftp.Client
+	hops   []*ssh.Client
+	tuning Tuning
+	// shared by the sessions of the connection
+	conn *connState
+}
+
+// connState is what is learned about one SSH connection, released by
+// Close together with it.
+type connState struct {
+	mu         sync.Mutex
+	ext        *extClient
+	packetSize int
+	rtt        time.Duration
+	checksums  map[checksumKey]*checksum
+	owners     map[ownerKey]string
+}
+
+func directDialer() Dialer {
+	return &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
 }
 
 func NewClient(serverAddr string, sshCfg *ssh.ClientConfig) (*Client, error) {
+	return newClient(directDialer(), serverAddr, sshCfg, Tuning{})
+}
+
+func newClient(dialer Dialer, serverAddr string, sshCfg *ssh.ClientConfig, tuning Tuning) (*Client, error) {
 	// Dial SSH
-	sshClient, err := dialServer(serverAddr, sshCfg)
+	sshClient, err := dialServer(dialer, serverAddr, sshCfg)
 	if err != nil {
 		return nil, fmt.Errorf("ssh dial failed: %w", err)
 	}
 
+	client := &Client{
+		Client: sshClient,
+		tuning: tuning,
+		conn:   &connState{},
+	}
+
 	// create sftp session
+	client.sftp, err = newSFTP(client)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// newSFTP opens an SFTP session on the connection of client.
+func newSFTP(client *Client) (*sftp.Client, error) {
 	sftpClient, err := sftp.NewClient(
-		sshClient,
-		sftp.MaxPacket(32*1024),
-		sftp.MaxConcurrentRequestsPerFile(64),
+		client.Client,
+		sftp.MaxPacketUnchecked(client.tuning.packetSize(client)),
+		sftp.MaxConcurrentRequestsPerFile(client.tuning.requests()),
+		// holes left by a failed write are tracked by the resume journal
+		sftp.UseConcurrentWrites(true),
 	)
 	if err != nil {
-		sshClient.Close()
 		return nil, fmt.Errorf("sftp session failed: %w", err)
 	}
-
-	return &Client{
-		Client: sshClient,
-		sftp:   sftpClient,
-	}, nil
+	return sftpClient, nil
 }
 
 func (c *Client) SFTP() *sftp.Client {
@@ -54,32 +101,63 @@ func (c *Client) Close() error {
 	if c.sftp != nil {
 		c.sftp.Close()
 	}
-	return c.Client.Close()
+	if c.conn != nil {
+		c.conn.release()
+	}
+	err := c.Client.Close()
+
+	// tear down the jump chain from the innermost hop outwards
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		c.hops[i].Close()
+	}
+	return err
+}
+
+// ext returns the extension channel of the connection, opened on first
+// use.
+func (c *Client) ext() (*extClient, error) {
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+
+	if c.conn.ext == nil {
+		ext, err := openExtClient(c.Client)
+		if err != nil {
+			return nil, err
+		}
+		c.conn.ext = ext
+	}
+	return c.conn.ext, nil
 }
 
-func dialServer(addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+// release closes the extension channel of the connection.
+func (s *connState) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ext != nil {
+		s.ext.Close()
+		s.ext = nil
+	}
+}
+
+func dialServer(dialer Dialer, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
 	addr, err := addDefaultPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	return func() (*ssh.Client, error) {
-		d := &net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}
 
-		conn, err := d.Dial("tcp", addr)
-		if err != nil {
-			return nil, err
-		}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
 
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
-		if err != nil {
-			return nil, err
-		}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-		return ssh.NewClient(sshConn, chans, reqs), nil
-	}()
+	return ssh.NewClient(sshConn, chans, reqs), nil
 }
 
 func addDefaultPort(addr string) (string, error) {
@@ -98,50 +176,213 @@ func addDefaultPort(addr string) (string, error) {
 	return addr, nil
 }
 
-func Initiate(user, host, keyPath string, port int) (string, *ssh.ClientConfig) {
-	if user == "" {
-		user = "root"
-	}
+// Endpoint is a resolved server address with the client config used to
+// authenticate against it, and the jump hosts to tunnel through.
+type Endpoint struct {
+	Addr   string
+	Config *ssh.ClientConfig
+	Jump   []*Endpoint
+	// user certificates offered during authentication
+	Certificates []*ssh.Certificate
+	Tuning       Tuning
+
+	auth   *authTracker
+	dialer Dialer
+	// shared with the jump hosts, closed by Close
+	agent *Agent
+}
 
-	if port == 0 {
-		port = 22
+// Close releases the ssh-agent connection. Clients already connected stay
+// open.
+func (e *Endpoint) Close() error {
+	if e.agent == nil {
+		return nil
 	}
+	return e.agent.Close()
+}
 
-	serverAddr := fmt.Sprintf("%s:%d", host, port)
+// AuthMethod reports the authentication method that last succeeded.
+func (e *Endpoint) AuthMethod() string {
+	return e.auth.Last()
+}
 
+// Connect dials every jump host in order, each one through the previous,
+// and opens the SFTP session on the final host. Only the first connection
+// goes through the proxy, if any.
+func (e *Endpoint) Connect() (*Client, error) {
 	var (
-		sshCfg *ssh.ClientConfig
-		err    error
+		dialer = e.dialer
+		hops   []*ssh.Client
 	)
 
-	if keyPath != "" {
-		keyData, err := os.ReadFile(keyPath)
-		if err != nil {
-			fmt.Printf("✗ Failed to read key: %v\n", err)
-			os.Exit(1)
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
 		}
-		sshCfg, err = NewSSHCfgPrivateKey(user, keyData)
+	}
+
+	for _, hop := range e.Jump {
+		hopClient, err := dialServer(dialer, hop.Addr, hop.Config)
 		if err != nil {
-			fmt.Printf("✗ Failed to create SSH config: %v\n", err)
-			os.Exit(1)
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %w", hop.Addr, err)
 		}
-	} else {
-		sshCfg, err = NewSSHCfgWithAllKeys(user)
-		if err != nil {
-			fmt.Printf("✗ %v\n", err)
-			os.Exit(1)
+		hops = append(hops, hopClient)
+		dialer = hopClient
+	}
+
+	client, err := newClient(dialer, e.Addr, e.Config, e.Tuning)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	client.hops = hops
+	return client, nil
+}
+
+func Initiate(opts Options) *Endpoint {
+	if opts.Host == "" {
+		fmt.Printf("✗ %v\n", ErrNoHost)
+		os.Exit(1)
+	}
+
+	unlocker, err := newKeyUnlocker(opts.PassphraseFile)
+	if err != nil {
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
+
+	// one agent connection serves the endpoint and every jump host
+	ag, err := AgentFromEnv()
+	if err != nil && !errors.Is(err, ErrNoAgent) {
+		fmt.Fprintf(os.Stderr, "⚠ %v\n", err)
+	}
+
+	ep, err := newEndpoint(opts, unlocker, ag)
+	if err != nil {
+		if ag != nil {
+			ag.Close()
+		}
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
+	ep.agent = ag
+	return ep
+}
+
+func newEndpoint(opts Options, unlocker *keyUnlocker, ag *Agent) (*Endpoint, error) {
+	raw := opts
+	opts, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	serverAddr := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
+
+	tuning := Tuning{
+		Workers:    opts.Workers,
+		BufferSize: opts.BufferSize,
+		PacketSize: opts.PacketSize,
+		Requests:   opts.Requests,
+	}
+	if err := tuning.validate(); err != nil {
+		return nil, err
+	}
+
+	sources, certs, err := keySources(opts, unlocker, ag)
+	if err != nil {
+		return nil, err
+	}
+
+	pw, err := newPasswordSource(opts.User, opts.Host, opts.PasswordStdin)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker := &authTracker{}
+	methods, err := authMethods(opts.AuthOrder, sources, pw, tracker)
+	if err != nil {
+		if errors.Is(err, ErrNoAuthMethods) {
+			err = ErrNoSSHClients
+		}
+		return nil, err
+	}
+
+	hostCAs, err := LoadHostCAs(opts.HostCAFiles...)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := HostKeyPolicy{
+		KnownHostsFiles:       opts.KnownHostsFiles,
+		GlobalKnownHostsFiles: opts.GlobalKnownHostsFiles,
+		StrictHostKeyChecking: opts.StrictHostKeyChecking,
+		HashKnownHosts:        opts.HashKnownHosts,
+		Fingerprints:          opts.HostKeyFingerprints,
+		HostCAs:               hostCAs,
+	}
+
+	algos, err := AlgorithmSpec{
+		Profile:      opts.CryptoProfile,
+		Ciphers:      opts.Ciphers,
+		MACs:         opts.MACs,
+		KeyExchanges: opts.KexAlgorithms,
+		HostKeys:     opts.HostKeyAlgorithms,
+	}.Resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	sshCfg := newSSHCfg(opts.User, methods...)
+	sshCfg.HostKeyCallback = policy.Callback()
+	sshCfg.HostKeyAlgorithms = algos.HostKeys
+	// only ask for a host certificate when a CA could verify it
+	if !policy.ExpectsCertificate(serverAddr) {
+		sshCfg.HostKeyAlgorithms = withoutCertAlgorithms(algos.HostKeys)
+		if len(sshCfg.HostKeyAlgorithms) == 0 {
+			return nil, fmt.Errorf("only host certificate algorithms allowed but no host CA is trusted")
 		}
 	}
 
 	sshCfg.Config = ssh.Config{
-		Ciphers: []string{
-			"chacha20-poly1305@openssh.com",
-			"aes128-gcm@openssh.com",
-		},
-		MACs: []string{
-			"hmac-sha2-256",
-		},
+		Ciphers:      algos.Ciphers,
+		MACs:         algos.MACs,
+		KeyExchanges: algos.KeyExchanges,
+	}
+
+	dialer, err := baseDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &Endpoint{
+		Addr:         serverAddr,
+		Config:       sshCfg,
+		Certificates: certs,
+		Tuning:       tuning,
+		auth:         tracker,
+		dialer:       dialer,
+	}
+
+	jumps, err := parseJumpHosts(opts.ProxyJump)
+	if err != nil {
+		return nil, err
+	}
+	for _, jump := range jumps {
+		// each hop resolves its own user, port and keys from ssh_config;
+		// a ProxyJump configured for the hop itself is not followed
+		hopOpts := jump.apply(raw)
+		hopOpts.User, hopOpts.Port = jump.User, jump.Port
+		hopOpts.ProxyJump = "none"
+		hopOpts.Proxy, hopOpts.ProxyCommand = "", "none"
+		hopOpts.HostKeyFingerprints = nil
+
+		hop, err := newEndpoint(hopOpts, unlocker, ag)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %w", jump.Host, err)
+		}
+		ep.Jump = append(ep.Jump, hop)
 	}
 
-	return serverAddr, sshCfg
+	return ep, nil
 }
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -10,6 +12,72 @@ import (
 
 const defaultConnTimeout = 3 * time.Second
 
+// SignerSource yields the signers offered for public key authentication.
+// It is evaluated when the server asks for keys, not when the config is built.
+type SignerSource func() ([]ssh.Signer, error)
+
+func StaticSigners(signers ...ssh.Signer) SignerSource {
+	return func() ([]ssh.Signer, error) {
+		return signers, nil
+	}
+}
+
+// chainSigners merges the sources in order, dropping keys already offered
+// by an earlier source. A failing source is reported but does not prevent
+// the remaining sources from being tried.
+func chainSigners(sources ...SignerSource) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		var (
+			signers []ssh.Signer
+			seen    [][]byte
+		)
+
+		for _, source := range sources {
+			list, err := source()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "⚠ %v\n", err)
+				continue
+			}
+
+		next:
+			for _, signer := range list {
+				pub := signer.PublicKey().Marshal()
+				for _, s := range seen {
+					if bytes.Equal(s, pub) {
+						continue next
+					}
+				}
+				seen = append(seen, pub)
+				signers = append(signers, signer)
+			}
+		}
+
+		if len(signers) == 0 {
+			return nil, ErrNoSSHClients
+		}
+		return signers, nil
+	}
+}
+
+func newSSHCfg(username string, auth ...ssh.AuthMethod) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: TOFUHostKeyCallback(),
+		Timeout:         defaultConnTimeout,
+	}
+}
+
+// NewSSHCfgWithSigners offers every signer from the sources, in order,
+// through a single publickey method.
+func NewSSHCfgWithSigners(username string, sources ...SignerSource) *ssh.ClientConfig {
+	return newSSHCfg(username, ssh.PublicKeysCallback(chainSigners(sources...)))
+}
+
+func NewSSHCfgWithAgent(username string, ag *Agent) *ssh.ClientConfig {
+	return NewSSHCfgWithSigners(username, ag.SignerSource())
+}
+
 func NewSSHCfgPrivateKey(username string, privPem []byte, passphrase ...string) (cfg *ssh.ClientConfig, err error) {
 	var priv ssh.Signer
 
@@ -24,19 +92,25 @@ func NewSSHCfgPrivateKey(username string, privPem []byte, passphrase ...string)
 		return
 	}
 
-	cfg = &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(priv),
-		},
-		HostKeyCallback: TOFUHostKeyCallback(),
-		Timeout:         defaultConnTimeout,
-	}
-
+	cfg = newSSHCfg(username, ssh.PublicKeys(priv))
 	return
 }
 
 func NewSSHCfgWithAllKeys(username string) (*ssh.ClientConfig, error) {
+	unlocker, err := newKeyUnlocker("")
+	if err != nil {
+		return nil, err
+	}
+
+	signers := defaultSigners(unlocker)
+	if len(signers) == 0 {
+		return nil, ErrNoSSHClients
+	}
+
+	return newSSHCfg(username, ssh.PublicKeys(signers...)), nil
+}
+
+func defaultSigners(unlocker *keyUnlocker) []ssh.Signer {
 	var signers []ssh.Signer
 
 	for _, path := range DefaultKeyPaths() {
@@ -45,26 +119,16 @@ func NewSSHCfgWithAllKeys(username string) (*ssh.ClientConfig, error) {
 			continue
 		}
 
-		signer, err := ssh.ParsePrivateKey(keyData)
+		signer, err := unlocker.loadSigner(path, keyData)
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "⚠ Skipping key '%s': %v\n", path, err)
 			continue
 		}
 
 		signers = append(signers, signer)
 	}
 
-	if len(signers) == 0 {
-		return nil, ErrNoSSHClients
-	}
-
-	return &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signers...),
-		},
-		HostKeyCallback: TOFUHostKeyCallback(),
-		Timeout:         defaultConnTimeout,
-	}, nil
+	return signers
 }
 
 func DefaultKeyPaths() []string {
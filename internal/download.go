@@ -7,58 +7,70 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
-
-	"github.com/pkg/sftp"
 )
 
-func (d *transfer) DownloadFile(localPath, remotePath string, offset int64, progress func(int)) error {
+// DownloadFile copies the byte range r of remotePath into localPath.
+func (d *transfer) DownloadFile(localPath, remotePath string, r byteRange, progress func(int)) error {
 	remote, err := d.client.Open(remotePath)
 	if err != nil {
 		return err
 	}
 	defer remote.Close()
 
-	if offset > 0 {
-		_, err = remote.Seek(offset, io.SeekStart)
-		if err != nil {
-			return fmt.Errorf("failed to seek remote file: %w", err)
-		}
-	}
-
-	flags := os.O_RDWR | os.O_CREATE
-	if offset == 0 {
-		flags |= os.O_TRUNC
-	}
-
-	local, err := os.OpenFile(localPath, flags, 0644)
+	local, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
 	defer local.Close()
 
-	return d.Chunker(remote, local, offset, progress)
+	d.tune(r.Len(), true)
+	return d.Chunker(io.NewSectionReader(remote, r.Start, r.Len()), local, r.Start, progress)
 }
 
-func Download(user, host string, port int, keypath, localpath, remotepath string, maxRetry int) {
-	serverAddr, sshCfg := Initiate(user, host, keypath, port)
-	retryCfg := DefaultRetry(maxRetry)
+func Download(opts Options, localpath, remotepath string) {
+	opts, remotepath = remoteArg(opts, remotepath)
+	opts, err := parseTransferOptions(opts)
+	if err != nil {
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
 
-	err := WithRetry(retryCfg, func() error {
-		client, err := NewClient(serverAddr, sshCfg)
-		if err != nil {
-			fmt.Printf("✗ Connection failed: %v\n", err)
-			os.Exit(1)
-		}
-		defer client.Close()
+	ep := Initiate(opts)
+	err = download(ep, opts, localpath, remotepath)
+	// os.Exit does not run deferred calls
+	ep.Close()
+	if err != nil {
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✓ Download successful\n")
+}
+
+// download connects and transfers remotepath, closing every connection
+// before it returns.
+func download(ep *Endpoint, opts Options, localpath, remotepath string) error {
+	pool, err := transferPool(ep, opts)
+	if err != nil {
+		return fmt.Errorf("Connection failed: %w", err)
+	}
+	defer pool.Close()
 
-		dataInfo, err := client.SFTP().Stat(remotepath)
+	err = WithRetry(DefaultRetry(opts.Retry), func() error {
+		var dataInfo os.FileInfo
+		err := pool.Do(func(client *Client) error {
+			var err error
+			dataInfo, err = client.SFTP().Stat(remotepath)
+			return err
+		})
 		if err != nil {
-			fmt.Printf("✗ Cannot access remote path: %v\n", err)
-			os.Exit(1)
+			if isRetryAble(err) {
+				return err
+			}
+			return fmt.Errorf("cannot access remote path: %w", err)
 		}
 
 		if dataInfo.IsDir() {
-			return downloadDir(client, remotepath, localpath)
+			return downloadDir(pool, opts, remotepath, localpath)
 		}
 		localInfo, statErr := os.Stat(localpath)
 		isLocalDir := statErr == nil && localInfo.IsDir()
@@ -66,23 +78,26 @@ func Download(user, host string, port int, keypath, localpath, remotepath string
 		if isLocalDir || strings.HasSuffix(localpath, "/") {
 			if !isLocalDir {
 				if err := os.MkdirAll(localpath, 0755); err != nil {
-					fmt.Printf("✗ Cannot create local directory: %v\n", err)
-					os.Exit(1)
+					return fmt.Errorf("cannot create local directory: %w", err)
 				}
 			}
 			localpath = filepath.ToSlash(filepath.Join(localpath, filepath.Base(remotepath)))
 		}
-		return downloadFile(client, remotepath, localpath)
+		if opts.Stripes > 1 && dataInfo.Size() > stripeRangeSize {
+			return downloadFileStriped(pool, opts, remotepath, localpath)
+		}
+		return pool.Do(func(client *Client) error {
+			return downloadFile(client, opts, remotepath, localpath)
+		})
 	})
 
 	if err != nil {
-		fmt.Printf("✗ Download failed: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("Download failed: %w", err)
 	}
-	fmt.Printf("✓ Download successful\n")
+	return nil
 }
 
-func downloadFile(client *Client, remotePath, localPath string) error {
+func downloadFile(client *Client, opts Options, remotePath, localPath string) error {
 	sftpClient := client.SFTP()
 	partPath := localPath + ".part"
 
@@ -91,84 +106,198 @@ func downloadFile(client *Client, remotePath, localPath string) error {
 		return fmt.Errorf("cannot stat remote file : %w", err)
 	}
 
-	var offset int64 = 0
-	localPartInfo, err := os.Stat(partPath)
-	if err == nil {
-		if localPartInfo.Size() < remoteInfo.Size() {
-			offset = localPartInfo.Size()
-			fmt.Printf("Resuming download from %d bytes (%.2f%%)\n",
-				offset, float64(offset)/float64(remoteInfo.Size())*100)
-		}
+	check, err := selectChecksum(client, opts)
+	if err != nil {
+		return err
+	}
+
+	store := localStore{}
+	j, err := resumeDownload(remoteInfo, partPath, opts.Sparse)
+	if err != nil {
+		return err
 	}
 
 	bar := progressBar(remoteInfo, remotePath)
-	if offset > 0 {
-		bar.Add64(offset)
+	bar.Add64(j.completed())
+
+	downloader := NewTransfer(client)
+	downloader.journal, downloader.store = j, store
+	if opts.Sparse {
+		downloader.sparse, downloader.holesFrom = true, holesFrom(os.Stat, partPath)
+	}
+	var part *partFile
+	if check != nil {
+		// blocks completed before a resume are hashed from the part file
+		if part, err = openPart(partPath, remoteInfo.Size(), opts.Sparse); err != nil {
+			return fmt.Errorf("cannot open part file: %w", err)
+		}
+		defer part.Close()
+		downloader.hash = newInlineHash(check.algo, part, remoteInfo.Size())
+	}
+	for _, r := range j.missing(0) {
+		err = downloader.DownloadFile(partPath, remotePath, r, func(n int) {
+			bar.Add(n)
+		})
+		if err != nil {
+			j.checkpoint(store, true)
+			return err
+		}
 	}
 
-	downloader := NewTransfer(sftpClient)
-	err = downloader.DownloadFile(partPath, remotePath, offset, func(n int) {
-		bar.Add(n)
+	localSum, err := downloader.sum()
+	if err != nil {
+		return fmt.Errorf("cannot hash part file: %w", err)
+	}
+	if part != nil {
+		// Windows cannot rename a file that is still open
+		part.Close()
+	}
+	return finishPart(client, opts, completePart{
+		localPath:  localPath,
+		remotePath: remotePath,
+		journal:    j,
+		check:      check,
+		localSum:   localSum,
+		preserve: func() error {
+			return preserveLocal(client, opts, remoteInfo, localPath)
+		},
 	})
+}
 
-	if err != nil {
-		return err
+// resumeDownload loads the journal of an interrupted download and checks
+// the blocks it lists against the local .part file, or creates an empty
+// .part file when there is nothing to resume.
+func resumeDownload(remoteInfo os.FileInfo, partPath string, sparse bool) (*journal, error) {
+	j := loadJournal(localStore{}, partPath, remoteInfo)
+
+	if j.completed() > 0 {
+		part, err := openPart(partPath, remoteInfo.Size(), sparse)
+		if err != nil {
+			j.reset()
+		} else {
+			dropped, err := j.verify(part)
+			part.Close()
+			if err != nil {
+				return nil, fmt.Errorf("cannot verify part file: %w", err)
+			}
+			if dropped > 0 {
+				fmt.Fprintf(os.Stderr, "⚠ %d blocks of %s are damaged, fetching them again\n", dropped, partPath)
+			}
+		}
 	}
 
-	_ = os.Remove(localPath)
-	err = os.Rename(partPath, localPath)
+	if done := j.completed(); done > 0 {
+		fmt.Printf("Resuming download, %d of %d bytes done (%.2f%%)\n", done, remoteInfo.Size(), float64(done)/float64(remoteInfo.Size())*100)
+		return j, nil
+	}
 
+	part, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to rename part file: %w", err)
+		return nil, err
 	}
+	return j, part.Close()
+}
 
-	fmt.Printf("Verifying integrity...\n")
-	if err := verifyIntegrity(client, localPath, remotePath); err != nil {
-		return fmt.Errorf("integrity check failed: %w", err)
-	}
-	fmt.Printf("✓ Integrity check passed\n")
-	return nil
+// partFile is a local .part file. A sparse one reads as zeros past its
+// end, where holes are left until the download completes.
+type partFile struct {
+	*os.File
+	data io.ReaderAt
 }
 
-func downloadDir(client *Client, remoteDir, localDir string) error {
-	sftpClient := client.SFTP()
+func (p *partFile) ReadAt(b []byte, off int64) (int, error) {
+	return p.data.ReadAt(b, off)
+}
+
+func openPart(partPath string, size int64, sparse bool) (*partFile, error) {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return nil, err
+	}
+	part := &partFile{File: f, data: f}
+	if sparse {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		part.data = zeroTail{r: f, size: fi.Size(), end: size}
+	}
+	return part, nil
+}
 
+func downloadDir(pool *Pool, opts Options, remoteDir, localDir string) error {
 	if err := os.MkdirAll(localDir, 0755); err != nil {
 		return fmt.Errorf("cannot create local directory : %w", err)
 	}
 
-	sem := make(chan struct{}, 4)
+	var dirs dirAttrs
+	if opts.preserve() {
+		err := pool.Do(func(client *Client) error {
+			fi, err := client.SFTP().Stat(remoteDir)
+			if err == nil {
+				dirs.add(localDir, fi)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("cannot stat remote directory: %w", err)
+		}
+	}
+
+	var hardlinks hardLinks
+	links := remoteHardLinks(pool, remoteDir)
+
+	sem := make(chan struct{}, pool.Size())
 	var (
 		wg   sync.WaitGroup
 		ferr error
 		mu   sync.Mutex
 	)
 
-	err := walkRemoteDir(sftpClient, remoteDir, func(path string, fi os.FileInfo) error {
+	err := walkTree(remoteTree{pool}, remoteDir, opts, func(path, rel string, fi os.FileInfo) error {
 		mu.Lock()
 		if ferr != nil {
 			mu.Unlock()
-			return fmt.Errorf("previous error")
+			return filepath.SkipAll
 		}
 		mu.Unlock()
 
-		relpath, err := filepath.Rel(remoteDir, path)
-		if err != nil {
-			return err
+		localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+		if link, ok := fi.(linkInfo); ok {
+			_ = os.Remove(localPath)
+			return os.Symlink(filepath.FromSlash(link.target), localPath)
 		}
-
-		localPath := filepath.Join(localDir, relpath)
 		if fi.IsDir() {
+			if opts.preserve() {
+				dirs.add(localPath, fi)
+			}
 			return os.MkdirAll(localPath, 0755)
 		}
 
+		var hl *hardLink
+		var first bool
+		if key, ok := links[rel]; ok {
+			hl, first = hardlinks.claim(key, localPath)
+		}
+
 		wg.Add(1)
 		sem <- struct{}{}
 		go func(src, dst string) {
 			defer wg.Done()
 			defer func() { <-sem }()
 
-			if err := downloadFile(client, src, dst); err != nil {
+			if hl != nil && !first && hardlinks.link(hl, dst, linkLocal) {
+				return
+			}
+
+			err := pool.Do(func(client *Client) error {
+				return downloadFile(client, opts, src, dst)
+			})
+			if first {
+				hl.finish(err)
+			}
+			if err != nil {
 				mu.Lock()
 				if ferr == nil {
 					ferr = err
@@ -187,27 +316,13 @@ func downloadDir(client *Client, remoteDir, localDir string) error {
 
 	mu.Lock()
 	defer mu.Unlock()
-	return ferr
-}
-
-func walkRemoteDir(client *sftp.Client, dir string, fn func(string, os.FileInfo) error) error {
-	entries, err := client.ReadDir(dir)
-	if err != nil {
-		return err
+	if ferr != nil {
+		return ferr
 	}
 
-	for _, entry := range entries {
-		path := filepath.ToSlash(filepath.Join(dir, entry.Name()))
-
-		if err := fn(path, entry); err != nil {
-			return err
-		}
-
-		if entry.IsDir() {
-			if err := walkRemoteDir(client, path, fn); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	return dirs.apply(func(path string, fi os.FileInfo) error {
+		return pool.Do(func(client *Client) error {
+			return preserveLocal(client, opts, fi, path)
+		})
+	})
 }
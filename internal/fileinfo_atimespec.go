@@ -0,0 +1,31 @@
+//go:build darwin || freebsd || netbsd
+
+package internal
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileAtime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Unix())
+	}
+	return fi.ModTime()
+}
+
+func fileOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid, true
+	}
+	return 0, 0, false
+}
+
+// hardLinkKey identifies a regular file with more than one link.
+func hardLinkKey(fi os.FileInfo) (fileKey, bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+		return fileKey{uint64(st.Dev), uint64(st.Ino)}, true
+	}
+	return fileKey{}, false
+}
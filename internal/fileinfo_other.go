@@ -0,0 +1,20 @@
+//go:build !linux && !openbsd && !dragonfly && !solaris && !darwin && !freebsd && !netbsd
+
+package internal
+
+import (
+	"os"
+	"time"
+)
+
+func fileAtime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
+
+func fileOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+func hardLinkKey(fi os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
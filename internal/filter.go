@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ignoreFileNames are read in every directory with --ignore-files.
+var ignoreFileNames = []string{".gitignore", ".goscpignore"}
+
+// parseFilterOptions reads the --exclude-from files into the exclude
+// patterns and checks every pattern.
+func parseFilterOptions(opts Options) (Options, error) {
+	exclude := append([]string{}, opts.Exclude...)
+	for _, file := range opts.ExcludeFrom {
+		data, err := os.ReadFile(expandHome(file))
+		if err != nil {
+			return opts, fmt.Errorf("cannot read --exclude-from: %w", err)
+		}
+		exclude = append(exclude, patternLines(data)...)
+	}
+	opts.Exclude, opts.ExcludeFrom = exclude, nil
+
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if r, ok := parseRule(pattern, "."); ok && !doublestar.ValidatePattern(r.pattern) {
+			return opts, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return opts, nil
+}
+
+// patternLines returns the lines of an exclude or ignore file.
+func patternLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// rule is one pattern in gitignore syntax. Without a slash it matches
+// the name at any depth, otherwise the path below base; a trailing slash
+// matches only directories and a leading ! includes again what earlier
+// rules excluded.
+type rule struct {
+	pattern  string
+	base     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseRule parses the pattern line found in the directory base, relative
+// to the transfer root. It returns false for blank lines and comments.
+func parseRule(line, base string) (rule, bool) {
+	line = strings.TrimRight(line, " \r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false
+	}
+
+	r := rule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// \# and \! start patterns that would be a comment or a negation
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return rule{}, false
+	}
+
+	r.pattern = line
+	return r, true
+}
+
+func (r rule) match(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+
+	name := rel
+	if r.base != "." {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		name = rel[len(r.base)+1:]
+	}
+	if !r.anchored {
+		name = path.Base(name)
+	}
+
+	ok, _ := doublestar.Match(r.pattern, name)
+	return ok
+}
+
+// filter decides which entries of a directory transfer are copied: those
+// matching an include pattern always are, the others unless the last
+// exclude or ignore file rule matching them excludes them.
+type filter struct {
+	include     []rule
+	exclude     []rule
+	ignoreFiles bool
+}
+
+func newFilter(opts Options) *filter {
+	f := &filter{ignoreFiles: opts.IgnoreFiles}
+	for _, pattern := range opts.Include {
+		if r, ok := parseRule(pattern, "."); ok {
+			f.include = append(f.include, r)
+		}
+	}
+	for _, pattern := range opts.Exclude {
+		if r, ok := parseRule(pattern, "."); ok {
+			f.exclude = append(f.exclude, r)
+		}
+	}
+	return f
+}
+
+// excluded reports whether rel, relative to the transfer root, is left
+// out. ignores are the rules of the ignore files above it, outermost
+// first.
+func (f *filter) excluded(rel string, dir bool, ignores []rule) bool {
+	for _, r := range f.include {
+		if r.match(rel, dir) {
+			return false
+		}
+	}
+
+	excluded := false
+	for _, rules := range [][]rule{f.exclude, ignores} {
+		for _, r := range rules {
+			if r.match(rel, dir) {
+				excluded = !r.negate
+			}
+		}
+	}
+	return excluded
+}
+
+// ignoreRules reads the ignore files among the entries of dir, rel below
+// the transfer root.
+func (f *filter) ignoreRules(t tree, dir, rel string, entries []os.FileInfo) []rule {
+	if !f.ignoreFiles {
+		return nil
+	}
+
+	var rules []rule
+	for _, name := range ignoreFileNames {
+		found := false
+		for _, fi := range entries {
+			if fi.Name() == name && fi.Mode().IsRegular() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		data, err := t.ReadFile(path.Join(dir, name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "⚠ Cannot read %s: %v\n", path.Join(dir, name), err)
+			continue
+		}
+		for _, line := range patternLines(data) {
+			if r, ok := parseRule(line, rel); ok && doublestar.ValidatePattern(r.pattern) {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules
+}
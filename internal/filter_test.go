@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFilterExcluded(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		// lines of an ignore file and the directory holding it
+		ignore    []string
+		ignoreDir string
+		path      string
+		dir       bool
+		want      bool
+	}{
+		{name: "no rules", path: "a/b.txt"},
+		{name: "name at any depth", exclude: []string{"*.log"}, path: "a/b/c.log", want: true},
+		{name: "name not matching", exclude: []string{"*.log"}, path: "a/b/c.txt"},
+		{name: "anchored path", exclude: []string{"build/*.o"}, path: "build/x.o", want: true},
+		{name: "anchored path deeper", exclude: []string{"build/*.o"}, path: "src/build/x.o"},
+		{name: "leading slash anchors", exclude: []string{"/vendor"}, path: "vendor", dir: true, want: true},
+		{name: "leading slash not deeper", exclude: []string{"/vendor"}, path: "a/vendor", dir: true},
+		{name: "double star", exclude: []string{"docs/**/*.png"}, path: "docs/a/b/c.png", want: true},
+		{name: "directory only rule on a directory", exclude: []string{"tmp/"}, path: "a/tmp", dir: true, want: true},
+		{name: "directory only rule on a file", exclude: []string{"tmp/"}, path: "a/tmp"},
+		{name: "later negation includes again", exclude: []string{"*.log", "!keep.log"}, path: "keep.log"},
+		{name: "negation before the rule", exclude: []string{"!keep.log", "*.log"}, path: "keep.log", want: true},
+		{name: "include wins over exclude", include: []string{"*.env"}, exclude: []string{".*"}, path: ".env"},
+		{name: "include alone excludes nothing else", include: []string{"*.go"}, path: "README"},
+		{name: "escaped hash", exclude: []string{`\#notes`}, path: "#notes", want: true},
+		{name: "comment", exclude: []string{"#notes"}, path: "#notes"},
+		{name: "trailing spaces", exclude: []string{"a.txt  "}, path: "a.txt", want: true},
+
+		{name: "ignore file", ignore: []string{"*.tmp"}, ignoreDir: ".", path: "x/y.tmp", want: true},
+		{name: "ignore file below its directory", ignore: []string{"*.tmp"}, ignoreDir: "x", path: "x/y/z.tmp", want: true},
+		{name: "ignore file outside its directory", ignore: []string{"*.tmp"}, ignoreDir: "x", path: "w/z.tmp"},
+		{name: "ignore file anchored to its directory", ignore: []string{"/out"}, ignoreDir: "x", path: "x/out", dir: true, want: true},
+		{name: "ignore file anchored, deeper", ignore: []string{"/out"}, ignoreDir: "x", path: "x/y/out", dir: true},
+		{name: "ignore file negates an exclude", exclude: []string{"*.tmp"}, ignore: []string{"!a.tmp"}, ignoreDir: ".", path: "a.tmp"},
+		{name: "ignore file with comments", ignore: []string{"# *.go", "", "*.tmp"}, ignoreDir: ".", path: "main.go"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFilter(Options{Include: tt.include, Exclude: tt.exclude})
+			var ignores []rule
+			for _, line := range tt.ignore {
+				if r, ok := parseRule(line, tt.ignoreDir); ok {
+					ignores = append(ignores, r)
+				}
+			}
+			if got := f.excluded(tt.path, tt.dir, ignores); got != tt.want {
+				t.Errorf("excluded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterOptions(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "exclude")
+	if err := os.WriteFile(from, []byte("# build output\n*.o\n\nbin/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		opts        Options
+		wantExclude []string
+		wantErr     string
+	}{
+		{
+			name:        "exclude-from appended",
+			opts:        Options{Exclude: []string{"*.log"}, ExcludeFrom: []string{from}},
+			wantExclude: []string{"*.log", "# build output", "*.o", "", "bin/"},
+		},
+		{
+			name:    "missing exclude-from",
+			opts:    Options{ExcludeFrom: []string{filepath.Join(dir, "missing")}},
+			wantErr: "cannot read --exclude-from",
+		},
+		{
+			name:    "invalid exclude",
+			opts:    Options{Exclude: []string{"a[b"}},
+			wantErr: `invalid pattern "a[b"`,
+		},
+		{
+			name:    "invalid include",
+			opts:    Options{Include: []string{"{a,b"}},
+			wantErr: `invalid pattern "{a,b"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFilterOptions(tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.Exclude, tt.wantExclude) || got.ExcludeFrom != nil {
+				t.Errorf("got exclude %q from %q, want %q", got.Exclude, got.ExcludeFrom, tt.wantExclude)
+			}
+		})
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":          "*.log\nbuild/\n!keep.log\n",
+		"a.txt":               "",
+		"debug.log":           "",
+		"keep.log":            "",
+		"build/out.bin":       "",
+		"src/main.go":         "",
+		"src/.goscpignore":    "/gen\n*.tmp\n",
+		"src/gen/x.go":        "",
+		"src/lib/gen/y.go":    "",
+		"src/lib/cache.tmp":   "",
+		"src/lib/server.log":  "",
+		"other/cache.tmp":     "",
+		"other/.gitignore":    "\\!bang\n",
+		"other/!bang":         "",
+		"other/sub/build":     "",
+		"docs/.goscpignore/x": "",
+	}
+	for name, data := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(opts Options) []string {
+		t.Helper()
+		var got []string
+		err := walkTree(localTree{}, filepath.ToSlash(root), opts, func(p, rel string, fi os.FileInfo) error {
+			if !fi.IsDir() {
+				got = append(got, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		return got
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "ignore files honoured",
+			opts: Options{IgnoreFiles: true},
+			want: []string{
+				".gitignore", "a.txt", "docs/.goscpignore/x", "keep.log",
+				"other/.gitignore", "other/cache.tmp", "other/sub/build",
+				"src/.goscpignore", "src/lib/gen/y.go", "src/main.go",
+			},
+		},
+		{
+			name: "include overrides an ignore file",
+			opts: Options{IgnoreFiles: true, Include: []string{"debug.log"}},
+			want: []string{
+				".gitignore", "a.txt", "debug.log", "docs/.goscpignore/x", "keep.log",
+				"other/.gitignore", "other/cache.tmp", "other/sub/build",
+				"src/.goscpignore", "src/lib/gen/y.go", "src/main.go",
+			},
+		},
+		{
+			name: "ignore files off",
+			opts: Options{Exclude: []string{".gitignore", ".goscpignore"}},
+			want: []string{
+				"a.txt", "build/out.bin", "debug.log", "keep.log",
+				"other/!bang", "other/cache.tmp", "other/sub/build",
+				"src/gen/x.go", "src/lib/cache.tmp", "src/lib/gen/y.go", "src/lib/server.log", "src/main.go",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := walk(tt.opts); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileKey identifies a file by device and inode.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// hardLinks tracks the hard linked files of a directory transfer: the
+// first path of each is copied, the others are linked to that copy.
+type hardLinks struct {
+	mu    sync.Mutex
+	first map[fileKey]*hardLink
+	// reports once that links are copied instead
+	unsupported sync.Once
+}
+
+type hardLink struct {
+	// destination of the copy
+	path string
+	done chan struct{}
+	err  error
+}
+
+// claim returns the copy to link dst to, or nil when key is new and the
+// caller copies it and calls finish.
+func (h *hardLinks) claim(key fileKey, dst string) (*hardLink, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if l, ok := h.first[key]; ok {
+		return l, false
+	}
+	if h.first == nil {
+		h.first = make(map[fileKey]*hardLink)
+	}
+	l := &hardLink{path: dst, done: make(chan struct{})}
+	h.first[key] = l
+	return l, true
+}
+
+func (l *hardLink) finish(err error) {
+	l.err = err
+	close(l.done)
+}
+
+// link waits for the copy and links dst to it with fn. It reports false
+// when dst has to be copied instead.
+func (h *hardLinks) link(l *hardLink, dst string, fn func(oldname, newname string) error) bool {
+	<-l.done
+	if l.err != nil {
+		return false
+	}
+	if err := fn(l.path, dst); err != nil {
+		h.unsupported.Do(func() {
+			fmt.Fprintf(os.Stderr, "⚠ Cannot create hard links, copying them instead: %v\n", err)
+		})
+		return false
+	}
+	return true
+}
+
+// linkRemote links newname to oldname with hardlink@openssh.com.
+func linkRemote(client *Client, oldname, newname string) error {
+	sftpClient := client.SFTP()
+	if _, ok := sftpClient.HasExtension("hardlink@openssh.com"); !ok {
+		return fmt.Errorf("server has no hardlink@openssh.com extension")
+	}
+	_ = sftpClient.Remove(newname)
+	return sftpClient.Link(oldname, newname)
+}
+
+func linkLocal(oldname, newname string) error {
+	_ = os.Remove(newname)
+	return os.Link(oldname, newname)
+}
+
+// remoteHardLinks returns the device and inode of the files below dir
+// with more than one link, by path relative to dir. SFTP does not carry
+// inodes, so on OpenSSH servers it asks GNU find. When find cannot run
+// it says so once and nothing is linked.
+func remoteHardLinks(pool *Pool, dir string) map[string]fileKey {
+	var output []byte
+	var findErr error
+	err := pool.Do(func(client *Client) error {
+		if _, ok := client.SFTP().HasExtension("hardlink@openssh.com"); !ok {
+			return nil
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			findErr = err
+			return nil
+		}
+		defer session.Close()
+
+		var stderr bytes.Buffer
+		session.Stderr = &stderr
+		output, err = session.Output(fmt.Sprintf(`find %s -type f -links +1 -printf '%%D %%i %%P\0'`, shellQuote(dir)))
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = fmt.Errorf("%w: %s", err, msg)
+			}
+			findErr = err
+		}
+		return nil
+	})
+	if err == nil {
+		err = findErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "⚠ Cannot look up hard links on the server, copying them: %v\n", err)
+		return nil
+	}
+
+	links := make(map[string]fileKey)
+	for _, line := range bytes.Split(output, []byte{0}) {
+		fields := strings.SplitN(string(line), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		dev, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		ino, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		links[fields[2]] = fileKey{dev, ino}
+	}
+	return links
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrHostCertificate = errors.New("host certificate verification failed")
+
+// LoadHostCAs reads CA public keys, one per line in authorized_keys
+// format, trusted to sign host certificates for any host.
+func LoadHostCAs(paths ...string) ([]ssh.PublicKey, error) {
+	var cas []ssh.PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read host CA: %w", err)
+		}
+
+		for len(bytes.TrimSpace(data)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse host CA '%s': %w", path, err)
+			}
+			cas = append(cas, key)
+			data = rest
+		}
+	}
+	return cas, nil
+}
+
+// trustsAuthority reports whether auth may sign host certificates for
+// hostname, either from --host-ca or a matching @cert-authority line.
+func (p HostKeyPolicy) trustsAuthority(kh *KnownHosts, auth ssh.PublicKey, hostname string) bool {
+	authData := auth.Marshal()
+	for _, ca := range p.HostCAs {
+		if bytes.Equal(ca.Marshal(), authData) {
+			return true
+		}
+	}
+
+	for _, ca := range kh.Authorities(hostname) {
+		if bytes.Equal(ca.Key.Marshal(), authData) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpectsCertificate reports whether any CA is trusted for hostname, in
+// which case the server should be asked for its host certificate.
+func (p HostKeyPolicy) ExpectsCertificate(hostname string) bool {
+	if len(p.Fingerprints) > 0 {
+		return false
+	}
+	if len(p.HostCAs) > 0 {
+		return true
+	}
+
+	kh, err := LoadKnownHosts(p.readFiles()...)
+	if err != nil {
+		return false
+	}
+	return len(kh.Authorities(hostname)) > 0
+}
+
+// certCallback verifies host certificates with ssh.CertChecker: signed by
+// a trusted CA, hostname among the principals, inside the validity window
+// and not @revoked. Plain keys go to the known hosts / TOFU fallback.
+func (p HostKeyPolicy) certCallback(fallback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if _, ok := key.(*ssh.Certificate); !ok {
+			return fallback(hostname, remote, key)
+		}
+
+		kh, err := LoadKnownHosts(p.readFiles()...)
+		if err != nil {
+			return fmt.Errorf("error while check known hosts: %w", err)
+		}
+
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+				return p.trustsAuthority(kh, auth, address)
+			},
+			IsRevoked: func(cert *ssh.Certificate) bool {
+				return kh.IsRevoked(cert) || kh.IsRevoked(cert.Key) || kh.IsRevoked(cert.SignatureKey)
+			},
+		}
+
+		if err := checker.CheckHostKey(hostname, remote, key); err != nil {
+			return fmt.Errorf("%w: %s", ErrHostCertificate, strings.TrimPrefix(err.Error(), "ssh: "))
+		}
+		return nil
+	}
+}
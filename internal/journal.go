@@ -0,0 +1,477 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	journalSuffix  = ".state"
+	journalVersion = 1
+
+	// files are tracked in blocks of at least this size, and of at most
+	// journalMaxBlocks blocks, to keep the journal small
+	journalBlockSize  = 4 * 1024 * 1024
+	journalMaxBlocks  = 4096
+	journalFlushEvery = 2 * time.Second
+)
+
+// byteRange is the half-open interval [Start, End) of a file.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r byteRange) Len() int64 {
+	return r.End - r.Start
+}
+
+// journalStore reads and writes the journal next to the .part file: on the
+// server for uploads, on the local disk for downloads.
+type journalStore interface {
+	load(path string) ([]byte, error)
+	save(path string, data []byte) error
+	remove(path string) error
+}
+
+type localStore struct{}
+
+func (localStore) load(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (localStore) save(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (localStore) remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localStore) truncate(path string, size int64) error {
+	return os.Truncate(path, size)
+}
+
+func (localStore) replace(oldpath, newpath string) error {
+	_ = os.Remove(newpath)
+	return os.Rename(oldpath, newpath)
+}
+
+type sftpStore struct {
+	client *sftp.Client
+}
+
+func (s sftpStore) load(path string) ([]byte, error) {
+	f, err := s.client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (s sftpStore) save(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := s.client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.client.PosixRename(tmp, path)
+	}
+	_ = s.client.Remove(path)
+	return s.client.Rename(tmp, path)
+}
+
+func (s sftpStore) remove(path string) error {
+	return s.client.Remove(path)
+}
+
+func (s sftpStore) truncate(path string, size int64) error {
+	return s.client.Truncate(path, size)
+}
+
+func (s sftpStore) replace(oldpath, newpath string) error {
+	_ = s.client.Remove(newpath)
+	return s.client.Rename(oldpath, newpath)
+}
+
+// partStore is the side of a transfer the .part file is written on.
+type partStore interface {
+	journalStore
+	truncate(path string, size int64) error
+	// replace renames oldpath to newpath, which may exist
+	replace(oldpath, newpath string) error
+}
+
+// journalFile is the on-disk form of the journal.
+type journalFile struct {
+	Version   int   `json:"version"`
+	Size      int64 `json:"size"`
+	ModTime   int64 `json:"mtime"`
+	BlockSize int64 `json:"block_size"`
+	// SHA-256 of every completed block, empty for missing ones
+	Blocks []string `json:"blocks"`
+}
+
+// journal records which blocks of a .part file are complete, with the hash
+// of each, so an interrupted transfer resumes exactly the missing blocks no
+// matter in which order chunks were written.
+type journal struct {
+	path      string
+	size      int64
+	modTime   int64
+	blockSize int64
+
+	mu      sync.Mutex
+	sums    []string
+	pending map[int64]string // hashed but not fully written
+	written map[int64]int64
+	dirty   bool
+
+	flushMu   sync.Mutex
+	lastFlush time.Time
+}
+
+func newJournal(path string, source os.FileInfo) *journal {
+	size := source.Size()
+	blockSize := int64(journalBlockSize)
+	if size/blockSize >= journalMaxBlocks {
+		blockSize = (size/journalMaxBlocks + journalBlockSize) / journalBlockSize * journalBlockSize
+	}
+
+	return &journal{
+		path:      path,
+		size:      size,
+		modTime:   source.ModTime().Unix(),
+		blockSize: blockSize,
+		sums:      make([]string, (size+blockSize-1)/blockSize),
+		pending:   make(map[int64]string),
+		written:   make(map[int64]int64),
+	}
+}
+
+// loadJournal returns the journal for the .part file at partPath. It starts
+// empty when there is none, or when the source changed since it was written.
+func loadJournal(store journalStore, partPath string, source os.FileInfo) *journal {
+	j := newJournal(partPath+journalSuffix, source)
+
+	data, err := store.load(j.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "⚠ Cannot read resume journal, starting over: %v\n", err)
+		}
+		return j
+	}
+
+	var f journalFile
+	if err := json.Unmarshal(data, &f); err != nil ||
+		f.Version != journalVersion || f.BlockSize != j.blockSize || len(f.Blocks) != len(j.sums) {
+		fmt.Fprintf(os.Stderr, "⚠ Resume journal %s is not usable, starting over\n", j.path)
+		return j
+	}
+	if f.Size != j.size || f.ModTime != j.modTime {
+		fmt.Fprintf(os.Stderr, "⚠ Source changed since the interrupted transfer, starting over\n")
+		return j
+	}
+
+	copy(j.sums, f.Blocks)
+	return j
+}
+
+func (j *journal) block(idx int64) byteRange {
+	start := idx * j.blockSize
+	return byteRange{start, min(start+j.blockSize, j.size)}
+}
+
+// blockSums returns the hash of every block, or nil while some are not
+// complete.
+func (j *journal) blockSums() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, sum := range j.sums {
+		if sum == "" {
+			return nil
+		}
+	}
+	return append([]string{}, j.sums...)
+}
+
+// completed returns the number of bytes in completed blocks.
+func (j *journal) completed() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var n int64
+	for idx, sum := range j.sums {
+		if sum != "" {
+			n += j.block(int64(idx)).Len()
+		}
+	}
+	return n
+}
+
+// missing returns the runs of incomplete blocks, cut into pieces of at
+// most maxLen bytes (rounded up to whole blocks) when maxLen is positive.
+func (j *journal) missing(maxLen int64) []byteRange {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	maxBlocks := int64(len(j.sums))
+	if maxLen > 0 {
+		maxBlocks = max(1, (maxLen+j.blockSize-1)/j.blockSize)
+	}
+
+	var ranges []byteRange
+	for idx := int64(0); idx < int64(len(j.sums)); idx++ {
+		if j.sums[idx] != "" {
+			continue
+		}
+		r := j.block(idx)
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].End == r.Start && ranges[last].Len() < maxBlocks*j.blockSize {
+			ranges[last].End = r.End
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// reset forgets every completed block.
+func (j *journal) reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	clear(j.sums)
+	j.dirty = true
+}
+
+// verify hashes every completed block of data again and forgets those that
+// no longer match. It returns the number of blocks dropped.
+func (j *journal) verify(data io.ReaderAt) (int, error) {
+	return j.verifyBlocks(func(r byteRange, _ string) (string, error) {
+		return blockSum(data, r)
+	})
+}
+
+// verifyBlocks forgets the completed blocks whose hash, as sum returns it,
+// differs from the one recorded. It returns the number of blocks dropped.
+func (j *journal) verifyBlocks(sum func(r byteRange, recorded string) (string, error)) (int, error) {
+	j.mu.Lock()
+	sums := append([]string{}, j.sums...)
+	j.mu.Unlock()
+
+	dropped := 0
+	for idx, recorded := range sums {
+		if recorded == "" {
+			continue
+		}
+
+		got, err := sum(j.block(int64(idx)), recorded)
+		if err != nil {
+			return dropped, err
+		}
+		if got == recorded {
+			continue
+		}
+
+		j.mu.Lock()
+		j.sums[idx] = ""
+		j.dirty = true
+		j.mu.Unlock()
+		dropped++
+	}
+	return dropped, nil
+}
+
+// lastBefore returns the last completed block starting before off.
+func (j *journal) lastBefore(off int64) (int64, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for idx := int64(len(j.sums)) - 1; idx >= 0; idx-- {
+		if j.sums[idx] != "" && j.block(idx).Start < off {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// blockSum returns the SHA-256 of the range r of data, or "" when data
+// ends before it.
+func blockSum(data io.ReaderAt, r byteRange) (string, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, io.NewSectionReader(data, r.Start, r.Len()))
+	if err != nil || n != r.Len() {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashed records the hash of a block read in full; written counts bytes
+// stored. A block is complete once both happened.
+func (j *journal) hashed(idx int64, sum string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.written[idx] >= j.block(idx).Len() {
+		j.complete(idx, sum)
+		return
+	}
+	j.pending[idx] = sum
+}
+
+func (j *journal) wrote(off, n int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for n > 0 {
+		idx := off / j.blockSize
+		r := j.block(idx)
+		take := min(n, r.End-off)
+
+		j.written[idx] += take
+		if j.written[idx] >= r.Len() {
+			if sum, ok := j.pending[idx]; ok {
+				j.complete(idx, sum)
+			}
+		}
+		off += take
+		n -= take
+	}
+}
+
+func (j *journal) complete(idx int64, sum string) {
+	j.sums[idx] = sum
+	j.dirty = true
+	delete(j.pending, idx)
+	delete(j.written, idx)
+}
+
+// checkpoint saves the journal if it changed, at most every
+// journalFlushEvery unless force is set.
+func (j *journal) checkpoint(store journalStore, force bool) error {
+	if force {
+		j.flushMu.Lock()
+	} else if !j.flushMu.TryLock() {
+		// another writer is saving it right now
+		return nil
+	}
+	defer j.flushMu.Unlock()
+
+	if !force && time.Since(j.lastFlush) < journalFlushEvery {
+		return nil
+	}
+
+	j.mu.Lock()
+	if !j.dirty {
+		j.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(journalFile{
+		Version:   journalVersion,
+		Size:      j.size,
+		ModTime:   j.modTime,
+		BlockSize: j.blockSize,
+		Blocks:    j.sums,
+	})
+	j.dirty = false
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	j.lastFlush = time.Now()
+	if err := store.save(j.path, data); err != nil {
+		j.mu.Lock()
+		j.dirty = true
+		j.mu.Unlock()
+		return fmt.Errorf("cannot save resume journal: %w", err)
+	}
+	return nil
+}
+
+func (j *journal) remove(store journalStore) {
+	_ = store.remove(j.path)
+}
+
+// track wraps the reader and writer of one block aligned range starting
+// at start, hashing what is read and counting what is written.
+func (j *journal) track(reader io.Reader, writer io.WriterAt, start int64, store journalStore) (io.Reader, io.WriterAt) {
+	return &journalReader{j: j, r: reader, off: start, h: sha256.New()},
+		&journalWriter{j: j, w: writer, store: store}
+}
+
+type journalReader struct {
+	j   *journal
+	r   io.Reader
+	off int64
+	h   hash.Hash
+}
+
+func (jr *journalReader) Read(p []byte) (int, error) {
+	n, err := jr.r.Read(p)
+
+	b := p[:n]
+	for len(b) > 0 {
+		idx := jr.off / jr.j.blockSize
+		end := jr.j.block(idx).End
+		take := min(int64(len(b)), end-jr.off)
+
+		jr.h.Write(b[:take])
+		jr.off += take
+		b = b[take:]
+
+		if jr.off == end {
+			jr.j.hashed(idx, hex.EncodeToString(jr.h.Sum(nil)))
+			jr.h.Reset()
+		}
+	}
+	return n, err
+}
+
+type journalWriter struct {
+	j     *journal
+	w     io.WriterAt
+	store journalStore
+}
+
+func (jw *journalWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := jw.w.WriteAt(p, off)
+	if n > 0 {
+		jw.j.record(jw.store, off, int64(n))
+	}
+	return n, err
+}
+
+// record counts n bytes stored at off, and saves the journal now and then.
+func (j *journal) record(store journalStore, off, n int64) {
+	j.wrote(off, n)
+	if err := j.checkpoint(store, false); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠ %v\n", err)
+	}
+}
@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+)
+
+// fileStat is the os.FileInfo of a source the journal tracks.
+type fileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func (f fileStat) Name() string       { return "source" }
+func (f fileStat) Size() int64        { return f.size }
+func (f fileStat) Mode() fs.FileMode  { return 0o644 }
+func (f fileStat) ModTime() time.Time { return f.modTime }
+func (f fileStat) IsDir() bool        { return false }
+func (f fileStat) Sys() any           { return nil }
+
+// memStore keeps journals in memory.
+type memStore map[string][]byte
+
+func (m memStore) load(path string) ([]byte, error) {
+	data, ok := m[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (m memStore) save(path string, data []byte) error {
+	m[path] = data
+	return nil
+}
+
+func (m memStore) remove(path string) error {
+	delete(m, path)
+	return nil
+}
+
+// memFile is a file being written at random offsets.
+type memFile struct {
+	data []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+// testSource returns size bytes that differ from block to block.
+func testSource(size int64) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i/7 + i/journalBlockSize)
+	}
+	return data
+}
+
+// journalFor returns a journal of source with the listed blocks completed.
+func journalFor(t *testing.T, source []byte, blocks ...int64) *journal {
+	t.Helper()
+	j := newJournal("part"+journalSuffix, fileStat{size: int64(len(source)), modTime: time.Unix(1700000000, 0)})
+	for _, idx := range blocks {
+		sum, err := blockSum(bytes.NewReader(source), j.block(idx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.sums[idx] = sum
+	}
+	return j
+}
+
+func completedBlocks(j *journal) []int64 {
+	var blocks []int64
+	for idx, sum := range j.sums {
+		if sum != "" {
+			blocks = append(blocks, int64(idx))
+		}
+	}
+	return blocks
+}
+
+func TestJournalMissing(t *testing.T) {
+	const block = journalBlockSize
+	source := make([]byte, 5*block+100)
+
+	tests := []struct {
+		name   string
+		done   []int64
+		maxLen int64
+		want   []byteRange
+	}{
+		{"nothing done", nil, 0, []byteRange{{0, 5*block + 100}}},
+		{"nothing done in pieces", nil, 2 * block, []byteRange{{0, 2 * block}, {2 * block, 4 * block}, {4 * block, 5*block + 100}}},
+		{"pieces round up to blocks", nil, block + 1, []byteRange{{0, 2 * block}, {2 * block, 4 * block}, {4 * block, 5*block + 100}}},
+		{"holes", []int64{0, 2, 3}, 0, []byteRange{{block, 2 * block}, {4 * block, 5*block + 100}}},
+		{"short last block done", []int64{5}, 0, []byteRange{{0, 5 * block}}},
+		{"everything done", []int64{0, 1, 2, 3, 4, 5}, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := journalFor(t, source, tt.done...)
+			got := j.missing(tt.maxLen)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestJournalTrack(t *testing.T) {
+	source := testSource(3*journalBlockSize + 1000)
+	store := memStore{}
+	j := journalFor(t, source)
+	part := &memFile{}
+
+	// the second block in two pieces written out of order, then the last
+	// block; the first never arrives
+	copyRange := func(start, end int64) {
+		t.Helper()
+		reader, writer := j.track(bytes.NewReader(source[start:end]), part, start, store)
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mid := len(data) / 2
+		writer.WriteAt(data[mid:], start+int64(mid))
+		writer.WriteAt(data[:mid], start)
+	}
+	copyRange(journalBlockSize, 2*journalBlockSize)
+	copyRange(3*journalBlockSize, int64(len(source)))
+	// hashed but only half written
+	reader, writer := j.track(bytes.NewReader(source[2*journalBlockSize:3*journalBlockSize]), part, 2*journalBlockSize, store)
+	io.ReadAll(reader)
+	writer.WriteAt(source[2*journalBlockSize:2*journalBlockSize+10], 2*journalBlockSize)
+
+	if got := completedBlocks(j); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Fatalf("completed blocks %v, want [1 3]", got)
+	}
+	if got, want := j.completed(), int64(journalBlockSize+1000); got != want {
+		t.Fatalf("completed %d bytes, want %d", got, want)
+	}
+
+	if err := j.checkpoint(store, true); err != nil {
+		t.Fatal(err)
+	}
+	resumed := loadJournal(store, "part", fileStat{size: j.size, modTime: time.Unix(j.modTime, 0)})
+	for idx := range j.sums {
+		if resumed.sums[idx] != j.sums[idx] {
+			t.Fatalf("block %d resumed as %q, want %q", idx, resumed.sums[idx], j.sums[idx])
+		}
+	}
+	if dropped, err := resumed.verify(bytes.NewReader(source)); err != nil || dropped != 0 {
+		t.Fatalf("verify dropped %d blocks, err %v", dropped, err)
+	}
+}
+
+func TestLoadJournal(t *testing.T) {
+	source := testSource(2*journalBlockSize + 10)
+	saved := journalFor(t, source, 0, 2)
+	stat := fileStat{size: saved.size, modTime: time.Unix(saved.modTime, 0)}
+
+	tests := []struct {
+		name   string
+		edit   func(f *journalFile)
+		stat   fileStat
+		resume bool
+	}{
+		{"unchanged", func(f *journalFile) {}, stat, true},
+		{"source grew", func(f *journalFile) {}, fileStat{size: stat.size + 1, modTime: stat.modTime}, false},
+		{"source touched", func(f *journalFile) {}, fileStat{size: stat.size, modTime: stat.modTime.Add(time.Second)}, false},
+		{"other version", func(f *journalFile) { f.Version++ }, stat, false},
+		{"other block size", func(f *journalFile) { f.BlockSize *= 2 }, stat, false},
+		{"missing blocks", func(f *journalFile) { f.Blocks = f.Blocks[:2] }, stat, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := journalFile{
+				Version:   journalVersion,
+				Size:      saved.size,
+				ModTime:   saved.modTime,
+				BlockSize: saved.blockSize,
+				Blocks:    append([]string{}, saved.sums...),
+			}
+			tt.edit(&f)
+			data, err := json.Marshal(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			j := loadJournal(memStore{saved.path: data}, "part", tt.stat)
+			if got := j.completed() > 0; got != tt.resume {
+				t.Fatalf("resumed %v, want %v", got, tt.resume)
+			}
+		})
+	}
+
+	if j := loadJournal(memStore{saved.path: []byte("{")}, "part", stat); j.completed() != 0 {
+		t.Fatal("resumed from a broken journal")
+	}
+	if j := loadJournal(memStore{}, "part", stat); j.completed() != 0 {
+		t.Fatal("resumed without a journal")
+	}
+}
+
+func TestReadBackPart(t *testing.T) {
+	source := testSource(3*journalBlockSize + 500)
+	size := int64(len(source))
+
+	damage := func(off int64) []byte {
+		part := append([]byte{}, source...)
+		part[off] ^= 0xff
+		return part
+	}
+
+	tests := []struct {
+		name string
+		// completed blocks and the remote .part file
+		done []int64
+		part []byte
+		// the .part file of a sparse transfer, holes at the end missing
+		sparse bool
+		full   bool
+		want   []int64
+	}{
+		{
+			name: "intact",
+			done: []int64{0, 1, 2, 3},
+			part: source,
+			want: []int64{0, 1, 2, 3},
+		},
+		{
+			name: "last block damaged",
+			done: []int64{0, 1, 2, 3},
+			part: damage(size - 1),
+			want: nil,
+		},
+		{
+			name: "earlier block damaged goes unnoticed",
+			done: []int64{0, 1, 2, 3},
+			part: damage(journalBlockSize),
+			want: []int64{0, 1, 2, 3},
+		},
+		{
+			name: "earlier block damaged, full read back",
+			done: []int64{0, 1, 2, 3},
+			part: damage(journalBlockSize),
+			full: true,
+			want: []int64{0, 2, 3},
+		},
+		{
+			name: "part file shorter than the journal says",
+			done: []int64{0, 1, 2, 3},
+			part: source[:2*journalBlockSize+10],
+			want: nil,
+		},
+		{
+			name: "part file shorter, full read back",
+			done: []int64{0, 1, 2, 3},
+			part: source[:2*journalBlockSize+10],
+			full: true,
+			want: []int64{0, 1},
+		},
+		{
+			name: "last block with data is checked, not the last block",
+			done: []int64{0, 2},
+			part: damage(2*journalBlockSize + 1)[:3*journalBlockSize],
+			want: nil,
+		},
+		{
+			name:   "sparse hole at the end",
+			done:   []int64{0, 1, 2, 3},
+			part:   source[:2*journalBlockSize],
+			sparse: true,
+			want:   []int64{0, 1, 2, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := source
+			if tt.sparse {
+				// the zeros past the data are what the source holds
+				src = append(append([]byte{}, source[:2*journalBlockSize]...), make([]byte, size-2*journalBlockSize)...)
+			}
+			j := journalFor(t, src, tt.done...)
+
+			partSize := int64(len(tt.part))
+			end := partSize
+			if tt.sparse {
+				partSize = 2 * journalBlockSize
+				end = size
+			}
+			data := zeroTail{r: bytes.NewReader(tt.part), size: partSize, end: end}
+
+			if _, err := readBackPart(j, data, partSize, tt.full); err != nil {
+				t.Fatal(err)
+			}
+			got := completedBlocks(j)
+			if len(got) != len(tt.want) {
+				t.Fatalf("kept blocks %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("kept blocks %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
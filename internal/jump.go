@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseJumpHosts parses a ProxyJump value: comma separated hops in the
+// form [user@]host[:port] or ssh://[user@]host[:port], first hop first.
+func parseJumpHosts(value string) ([]RemoteSpec, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "none") {
+		return nil, nil
+	}
+
+	var hops []RemoteSpec
+	for _, hop := range strings.Split(value, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		if hop == "" {
+			return nil, fmt.Errorf("empty jump host in %q", value)
+		}
+
+		var spec RemoteSpec
+		if at := strings.LastIndex(hop, "@"); at >= 0 {
+			spec.User = hop[:at]
+			hop = hop[at+1:]
+		}
+
+		host, port, err := net.SplitHostPort(hop)
+		if err != nil {
+			// no port given
+			host = strings.Trim(hop, "[]")
+		} else {
+			spec.Port, err = strconv.Atoi(port)
+			if err != nil || spec.Port <= 0 || spec.Port > 65535 {
+				return nil, fmt.Errorf("invalid port in jump host %q", hop)
+			}
+		}
+		if host == "" {
+			return nil, fmt.Errorf("empty jump host in %q", value)
+		}
+		spec.Host = host
+
+		hops = append(hops, spec)
+	}
+	return hops, nil
+}
@@ -2,71 +2,334 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	markerCertAuthority = "@cert-authority"
+	markerRevoked       = "@revoked"
+
+	hashedHostPrefix = "|1|"
+)
+
+var DefaultGlobalKnownHostsFiles = []string{
+	"/etc/ssh/ssh_known_hosts",
+	"/etc/ssh/ssh_known_hosts2",
+}
+
 func knownHostsPath() string {
 	home, _ := os.UserHomeDir()
 	return filepath.Join(home, ".ssh", "known_hosts")
 }
 
-func isHostsKnown(hostname string, key ssh.PublicKey) (bool, error) {
-	file, err := os.Open(knownHostsPath())
-	if os.IsNotExist(err) {
-		return false, nil
+// HostKeyPolicy decides how server host keys are verified. The first
+// user known hosts file is the one new keys are written to, global files
+// are only read.
+type HostKeyPolicy struct {
+	KnownHostsFiles       []string
+	GlobalKnownHostsFiles []string
+	StrictHostKeyChecking string
+	HashKnownHosts        bool
+	// pinned SHA256 fingerprints, when set known hosts are not consulted
+	Fingerprints []string
+	// CAs trusted to sign host certificates for every host
+	HostCAs []ssh.PublicKey
+}
+
+func (p HostKeyPolicy) files() []string {
+	if len(p.KnownHostsFiles) == 0 {
+		return []string{knownHostsPath()}
+	}
+	return p.KnownHostsFiles
+}
+
+func (p HostKeyPolicy) globalFiles() []string {
+	if p.GlobalKnownHostsFiles == nil {
+		return DefaultGlobalKnownHostsFiles
+	}
+	return p.GlobalKnownHostsFiles
+}
+
+func (p HostKeyPolicy) readFiles() []string {
+	return append(append([]string{}, p.files()...), p.globalFiles()...)
+}
+
+const (
+	StrictYes       = "yes"
+	StrictNo        = "no"
+	StrictAcceptNew = "accept-new"
+	StrictAsk       = "ask"
+)
+
+var (
+	ErrHostKeyChanged   = errors.New("host key verification failed: remote host identification has changed")
+	ErrHostKeyRevoked   = errors.New("host key verification failed: host key is revoked")
+	ErrHostKeyNotPinned = errors.New("host key verification failed: fingerprint does not match")
+)
+
+// ParseStrictHostKeyChecking normalizes a StrictHostKeyChecking value.
+func ParseStrictHostKeyChecking(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", StrictAsk:
+		return StrictAsk, nil
+	case StrictYes, "true":
+		return StrictYes, nil
+	case StrictNo, "off", "false":
+		return StrictNo, nil
+	case StrictAcceptNew:
+		return StrictAcceptNew, nil
+	default:
+		return "", fmt.Errorf("invalid strict host key checking mode %q (use yes, no, accept-new or ask)", value)
+	}
+}
+
+// KnownKey is a host key entry read from a known hosts file.
+type KnownKey struct {
+	Key      ssh.PublicKey
+	Filename string
+	Line     int
+}
+
+// HostKeyError is returned when the presented key is not in known hosts.
+// Want lists the entries of the same key type recorded for the host; when
+// it is empty the host is simply unknown, otherwise its key has changed.
+type HostKeyError struct {
+	Hostname string
+	Key      ssh.PublicKey
+	Want     []KnownKey
+	// keys of another type known for the host, which are not a mismatch
+	Other []KnownKey
+}
+
+func (e *HostKeyError) Error() string {
+	if len(e.Want) == 0 {
+		return fmt.Sprintf("host %s is not in known hosts", e.Hostname)
 	}
+	return fmt.Sprintf("%s key for %s does not match %s:%d",
+		e.Key.Type(), e.Hostname, e.Want[0].Filename, e.Want[0].Line)
+}
 
+func (e *HostKeyError) Changed() bool {
+	return len(e.Want) > 0
+}
+
+type knownHostsEntry struct {
+	KnownKey
+	marker string
+	hosts  string
+}
+
+// matches implements the OpenSSH host field: either a single hashed
+// "|1|salt|hash" entry or comma separated patterns where '*' and '?' are
+// wildcards and a matching "!pattern" excludes the host.
+func (e *knownHostsEntry) matches(hostname string) bool {
+	if strings.HasPrefix(e.hosts, hashedHostPrefix) {
+		parts := strings.Split(e.hosts[len(hashedHostPrefix):], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		want, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		return hmac.Equal(hashHost(salt, hostname), want)
+	}
+
+	return matchPatternList(strings.Split(e.hosts, ","), hostname)
+}
+
+// KnownHosts is the combined content of one or more known_hosts files.
+type KnownHosts struct {
+	entries []knownHostsEntry
+}
+
+// LoadKnownHosts reads the files in order, skipping those that do not
+// exist. Malformed lines are ignored as OpenSSH does.
+func LoadKnownHosts(files ...string) (*KnownHosts, error) {
+	kh := &KnownHosts{}
+	for _, path := range files {
+		if err := kh.load(path); err != nil {
+			return nil, err
+		}
+	}
+	return kh, nil
+}
+
+func (k *KnownHosts) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return false, err
+		return err
 	}
 	defer file.Close()
 
-	hostname = normalizeHostname(hostname)
-	keyType := key.Type()
-	keyData := base64.StdEncoding.EncodeToString(key.Marshal())
-
 	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
 	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") || len(line) == 0 {
+		lineNo++
+		entry, ok := parseKnownHostsLine(scanner.Text())
+		if !ok {
 			continue
 		}
+		entry.Filename = path
+		entry.Line = lineNo
+		k.entries = append(k.entries, entry)
+	}
 
-		parts := strings.Fields(line)
-		if len(parts) >= 3 {
-			hosts := strings.Split(parts[0], ",")
-			for _, h := range hosts {
-				if h == hostname && parts[1] == keyType && parts[2] == keyData {
-					return true, nil
-				}
-			}
+	return scanner.Err()
+}
+
+func parseKnownHostsLine(line string) (knownHostsEntry, bool) {
+	var entry knownHostsEntry
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return entry, false
+	}
+
+	if strings.HasPrefix(fields[0], "@") {
+		entry.marker = fields[0]
+		if entry.marker != markerCertAuthority && entry.marker != markerRevoked {
+			return entry, false
 		}
+		fields = fields[1:]
+	}
+
+	if len(fields) < 3 {
+		return entry, false
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1] + " " + fields[2]))
+	if err != nil {
+		return entry, false
 	}
 
-	return false, scanner.Err()
+	entry.hosts = fields[0]
+	entry.Key = key
+	return entry, true
+}
+
+// Check returns nil when the key is recorded for hostname, ErrHostKeyRevoked
+// when it is listed as @revoked, or a *HostKeyError otherwise.
+func (k *KnownHosts) Check(hostname string, key ssh.PublicKey) error {
+	hostname = normalizeHostname(hostname)
+	keyData := key.Marshal()
+	keyErr := &HostKeyError{Hostname: hostname, Key: key}
+
+	// a revoked key is refused for every host
+	if revoked, ok := k.revoked(key); ok {
+		return fmt.Errorf("%w (%s:%d)", ErrHostKeyRevoked, revoked.Filename, revoked.Line)
+	}
+
+	for _, entry := range k.entries {
+		if entry.marker != "" || !entry.matches(hostname) {
+			continue
+		}
+
+		switch {
+		case entry.Key.Type() != key.Type():
+			keyErr.Other = append(keyErr.Other, entry.KnownKey)
+		case bytes.Equal(entry.Key.Marshal(), keyData):
+			return nil
+		default:
+			keyErr.Want = append(keyErr.Want, entry.KnownKey)
+		}
+	}
+
+	return keyErr
+}
+
+// Authorities returns the @cert-authority keys trusted for hostname.
+func (k *KnownHosts) Authorities(hostname string) []KnownKey {
+	hostname = normalizeHostname(hostname)
+
+	var cas []KnownKey
+	for _, entry := range k.entries {
+		if entry.marker == markerCertAuthority && entry.matches(hostname) {
+			cas = append(cas, entry.KnownKey)
+		}
+	}
+	return cas
+}
+
+// IsRevoked reports whether key is listed with the @revoked marker.
+func (k *KnownHosts) IsRevoked(key ssh.PublicKey) bool {
+	_, ok := k.revoked(key)
+	return ok
+}
+
+func (k *KnownHosts) revoked(key ssh.PublicKey) (KnownKey, bool) {
+	keyData := key.Marshal()
+	for _, entry := range k.entries {
+		if entry.marker == markerRevoked && bytes.Equal(entry.Key.Marshal(), keyData) {
+			return entry.KnownKey, true
+		}
+	}
+	return KnownKey{}, false
+}
+
+func hashHost(salt []byte, hostname string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(hostname))
+	return mac.Sum(nil)
+}
+
+// HashHostname returns hostname in the "|1|salt|hash" form written by
+// OpenSSH with HashKnownHosts enabled.
+func HashHostname(hostname string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	return hashedHostPrefix +
+		base64.StdEncoding.EncodeToString(salt) + "|" +
+		base64.StdEncoding.EncodeToString(hashHost(salt, normalizeHostname(hostname))), nil
 }
 
 func AddHostKey(hostname string, key ssh.PublicKey) error {
-	sshDir := filepath.Dir(knownHostsPath())
-	if err := os.MkdirAll(sshDir, 0700); err != nil {
+	return addHostKey(knownHostsPath(), hostname, key, false)
+}
+
+func addHostKey(path, hostname string, key ssh.PublicKey, hashed bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(knownHostsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
 	hostname = normalizeHostname(hostname)
+	if hashed {
+		hostname, err = HashHostname(hostname)
+		if err != nil {
+			return err
+		}
+	}
 	keyType := key.Type()
 	keyData := base64.StdEncoding.EncodeToString(key.Marshal())
 
@@ -94,34 +357,148 @@ func normalizeHostname(hostname string) string {
 }
 
 func TOFUHostKeyCallback() ssh.HostKeyCallback {
+	return HostKeyPolicy{}.Callback()
+}
+
+// hostKeyMu serializes the decision about unknown hosts, so parallel
+// connections to the same new host ask and record it only once.
+var hostKeyMu sync.Mutex
+
+// Callback verifies host certificates against the trusted CAs and plain
+// host keys against known hosts.
+func (p HostKeyPolicy) Callback() ssh.HostKeyCallback {
+	return p.certCallback(p.knownHostsCallback())
+}
+
+func (p HostKeyPolicy) knownHostsCallback() ssh.HostKeyCallback {
+	files := p.files()
+	readFiles := p.readFiles()
+
 	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		known, err := isHostsKnown(hostname, key)
-		if err != nil {
-			return fmt.Errorf("error while check known hosts: %w", err)
+		if len(p.Fingerprints) > 0 {
+			return checkPinned(p.Fingerprints, hostname, key)
 		}
 
-		if known {
-			return nil
+		err := verifyKnownHost(readFiles, hostname, key)
+
+		var keyErr *HostKeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		hostKeyMu.Lock()
+		defer hostKeyMu.Unlock()
+
+		// another connection may have accepted the key while we waited
+		err = verifyKnownHost(readFiles, hostname, key)
+		if !errors.As(err, &keyErr) {
+			return err
 		}
 
 		fingerprint := Fingerprint(key)
 
-		fmt.Printf("\n")
-		fmt.Printf("The authenticity of host '%s' can't be established.\n", hostname)
-		fmt.Printf("%s key fingerprint is %s\n", key.Type(), fingerprint)
-		fmt.Printf("Are you sure you want to continue connecting (yes/no)? ")
-		var answer string
-		fmt.Scanln(&answer)
-		answer = strings.ToLower(strings.TrimSpace(answer))
-		if answer != "yes" {
-			return fmt.Errorf("host key verification rejected by user")
+		switch p.StrictHostKeyChecking {
+		case StrictYes:
+			return fmt.Errorf("no %s host key is known for %s (fingerprint %s) and strict checking is enabled",
+				key.Type(), hostname, fingerprint)
+		case StrictNo, StrictAcceptNew:
+		default:
+			if err := confirmHostKey(hostname, key, keyErr.Other); err != nil {
+				return err
+			}
 		}
 
-		if err := AddHostKey(hostname, key); err != nil {
-			fmt.Printf("Warning: Could not save host key: %v\n", key)
+		if err := addHostKey(files[0], hostname, key, p.HashKnownHosts); err != nil {
+			fmt.Printf("Warning: Could not save host key: %v\n", err)
 		} else {
 			fmt.Printf("Warning: Permanently added '%s' to known hosts.\n", hostname)
 		}
 		return nil
 	}
 }
+
+// verifyKnownHost returns nil for a known key, a *HostKeyError for an
+// unknown host, and a hard error for revoked or changed keys.
+func verifyKnownHost(files []string, hostname string, key ssh.PublicKey) error {
+	kh, err := LoadKnownHosts(files...)
+	if err != nil {
+		return fmt.Errorf("error while check known hosts: %w", err)
+	}
+
+	err = kh.Check(hostname, key)
+	if errors.Is(err, ErrHostKeyRevoked) {
+		fmt.Fprintf(os.Stderr, "@ WARNING: REVOKED HOST KEY DETECTED! %s key for %s is marked as revoked.\n",
+			key.Type(), normalizeHostname(hostname))
+		return err
+	}
+
+	// a changed key is never accepted, whatever the checking mode
+	var keyErr *HostKeyError
+	if errors.As(err, &keyErr) && keyErr.Changed() {
+		printHostKeyChanged(keyErr)
+		return ErrHostKeyChanged
+	}
+	return err
+}
+
+func confirmHostKey(hostname string, key ssh.PublicKey, other []KnownKey) error {
+	fingerprint := Fingerprint(key)
+
+	var question strings.Builder
+	fmt.Fprintf(&question, "\nThe authenticity of host '%s' can't be established.\n", hostname)
+	fmt.Fprintf(&question, "%s key fingerprint is %s\n", key.Type(), fingerprint)
+	for _, o := range other {
+		fmt.Fprintf(&question, "This host is known by a %s key in %s:%d\n", o.Key.Type(), o.Filename, o.Line)
+	}
+	question.WriteString("Are you sure you want to continue connecting (yes/no/[fingerprint])? ")
+
+	answer, err := readLine(question.String())
+	if errors.Is(err, ErrNoTTY) {
+		return fmt.Errorf("cannot confirm unknown host %s without a terminal, use --strict-host-key-checking=accept-new or --host-key-fingerprint", hostname)
+	}
+	if err != nil {
+		return err
+	}
+
+	answer = strings.TrimSpace(answer)
+	if strings.EqualFold(answer, "yes") || sameFingerprint(answer, fingerprint) {
+		return nil
+	}
+	return fmt.Errorf("host key verification rejected by user")
+}
+
+func checkPinned(pins []string, hostname string, key ssh.PublicKey) error {
+	fingerprint := Fingerprint(key)
+	for _, pin := range pins {
+		if sameFingerprint(pin, fingerprint) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s presented %s key %s", ErrHostKeyNotPinned, hostname, key.Type(), fingerprint)
+}
+
+// sameFingerprint compares SHA256 fingerprints with or without the
+// base64 padding OpenSSH leaves off.
+func sameFingerprint(a, b string) bool {
+	a = strings.TrimRight(strings.TrimSpace(a), "=")
+	b = strings.TrimRight(strings.TrimSpace(b), "=")
+	return a != "" && a == b
+}
+
+func printHostKeyChanged(keyErr *HostKeyError) {
+	keyType := strings.ToUpper(strings.TrimPrefix(keyErr.Key.Type(), "ssh-"))
+
+	fmt.Fprintf(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+	fmt.Fprintf(os.Stderr, "@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @\n")
+	fmt.Fprintf(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+	fmt.Fprintf(os.Stderr, "IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!\n")
+	fmt.Fprintf(os.Stderr, "Someone could be eavesdropping on you right now (man-in-the-middle attack)!\n")
+	fmt.Fprintf(os.Stderr, "It is also possible that a host key has just been changed.\n")
+	fmt.Fprintf(os.Stderr, "The fingerprint for the %s key sent by the remote host %s is\n%s.\n",
+		keyType, keyErr.Hostname, Fingerprint(keyErr.Key))
+	fmt.Fprintf(os.Stderr, "Please contact your system administrator.\n")
+	for _, want := range keyErr.Want {
+		fmt.Fprintf(os.Stderr, "Offending %s key in %s:%d\n", keyType, want.Filename, want.Line)
+	}
+	fmt.Fprintf(os.Stderr, "Remove the offending line once the new key is confirmed to be correct.\n")
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func hashedHost(t *testing.T, hostname string) string {
+	t.Helper()
+	hashed, err := HashHostname(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashed
+}
+
+func knownHostsLine(marker, hosts string, key ssh.PublicKey) string {
+	line := fmt.Sprintf("%s %s", hosts, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	if marker != "" {
+		line = marker + " " + line
+	}
+	return line
+}
+
+func TestKnownHostsEntryMatches(t *testing.T) {
+	tests := []struct {
+		hosts    string
+		hostname string
+		want     bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "other.com", false},
+		{"EXAMPLE.com", "example.COM", true},
+		{"a.com,example.com", "example.com", true},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"web?.example.com", "web1.example.com", true},
+		{"web?.example.com", "web10.example.com", false},
+		{"*.example.com,!db.example.com", "db.example.com", false},
+		{"!db.example.com,*.example.com", "db.example.com", false},
+		{"!db.example.com", "www.example.com", false},
+		{"10.0.0.*", "10.0.0.7", true},
+		{"[example.com]:2222", "[example.com]:2222", true},
+		{"[example.com]:2222", "example.com", false},
+		{"[*.example.com]:*", "[www.example.com]:2222", true},
+		{hashedHost(t, "example.com"), "example.com", true},
+		{hashedHost(t, "example.com"), "other.com", false},
+		{hashedHost(t, "[example.com]:2222"), "[example.com]:2222", true},
+		{hashedHost(t, "[example.com]:2222"), "example.com", false},
+		{"|1|bm90IGJhc2U2NA|", "example.com", false},
+		{"|1|!!!|!!!", "example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hosts+" "+tt.hostname, func(t *testing.T) {
+			e := knownHostsEntry{hosts: tt.hosts}
+			if got := e.matches(tt.hostname); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKnownHostsLine(t *testing.T) {
+	key := newHostKey(t)
+	keyText := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+
+	tests := []struct {
+		name       string
+		line       string
+		wantOK     bool
+		wantMarker string
+		wantHosts  string
+	}{
+		{name: "plain", line: "example.com " + keyText, wantOK: true, wantHosts: "example.com"},
+		{name: "comment after the key", line: "example.com " + keyText + " root@example", wantOK: true, wantHosts: "example.com"},
+		{name: "cert authority", line: "@cert-authority *.example.com " + keyText, wantOK: true, wantMarker: markerCertAuthority, wantHosts: "*.example.com"},
+		{name: "revoked", line: "@revoked * " + keyText, wantOK: true, wantMarker: markerRevoked, wantHosts: "*"},
+		{name: "blank", line: "   "},
+		{name: "comment", line: "# example.com " + keyText},
+		{name: "unknown marker", line: "@trusted example.com " + keyText},
+		{name: "marker only", line: "@revoked " + keyText},
+		{name: "no key", line: "example.com ssh-ed25519"},
+		{name: "broken key", line: "example.com ssh-ed25519 AAAA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, ok := parseKnownHostsLine(tt.line)
+			if ok != tt.wantOK {
+				t.Fatalf("parsed %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if entry.marker != tt.wantMarker || entry.hosts != tt.wantHosts {
+				t.Errorf("got marker %q hosts %q, want %q %q", entry.marker, entry.hosts, tt.wantMarker, tt.wantHosts)
+			}
+			if string(entry.Key.Marshal()) != string(key.Marshal()) {
+				t.Error("key differs")
+			}
+		})
+	}
+}
+
+func TestKnownHostsCheck(t *testing.T) {
+	var (
+		webKey     = newHostKey(t)
+		portKey    = newHostKey(t)
+		hashedKey  = newHostKey(t)
+		wildKey    = newHostKey(t)
+		revokedKey = newHostKey(t)
+		caKey      = newHostKey(t)
+		otherKey   = newHostKey(t)
+	)
+	ecdsaPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ssh.NewPublicKey(&ecdsaPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{
+		"# test hosts",
+		knownHostsLine("", "web.example.com,192.0.2.1", webKey),
+		knownHostsLine("", "[web.example.com]:2222", portKey),
+		knownHostsLine("", hashedHost(t, "secret.example.com"), hashedKey),
+		knownHostsLine("", "*.lab.example.com,!db.lab.example.com", wildKey),
+		knownHostsLine("", "ecdsa.example.com", ecdsaKey),
+		knownHostsLine(markerRevoked, "*", revokedKey),
+		knownHostsLine("", "old.example.com", revokedKey),
+		knownHostsLine(markerCertAuthority, "*.example.com", caKey),
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kh, err := LoadKnownHosts(path, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hostname string
+		key      ssh.PublicKey
+		// nil, ErrHostKeyRevoked, or a *HostKeyError with Changed() as set
+		wantErr     error
+		wantChanged bool
+		// line of the entry the changed key was recorded at
+		wantLine int
+		// keys of another type recorded for the host
+		wantOther int
+	}{
+		{name: "known", hostname: "web.example.com:22", key: webKey},
+		{name: "known by address", hostname: "192.0.2.1:22", key: webKey},
+		{name: "known on a port", hostname: "web.example.com:2222", key: portKey},
+		{name: "changed", hostname: "web.example.com:22", key: otherKey, wantErr: &HostKeyError{}, wantChanged: true, wantLine: 2},
+		{name: "port entry is another host", hostname: "web.example.com:2222", key: webKey, wantErr: &HostKeyError{}, wantChanged: true, wantLine: 3},
+		{name: "unknown", hostname: "new.example.org:22", key: otherKey, wantErr: &HostKeyError{}},
+		{name: "hashed", hostname: "secret.example.com:22", key: hashedKey},
+		{name: "hashed changed", hostname: "secret.example.com:22", key: otherKey, wantErr: &HostKeyError{}, wantChanged: true, wantLine: 4},
+		{name: "hashed on another port", hostname: "secret.example.com:2222", key: hashedKey, wantErr: &HostKeyError{}},
+		{name: "wildcard", hostname: "node1.lab.example.com:22", key: wildKey},
+		{name: "wildcard negated", hostname: "db.lab.example.com:22", key: wildKey, wantErr: &HostKeyError{}},
+		{name: "other key type", hostname: "ecdsa.example.com:22", key: otherKey, wantErr: &HostKeyError{}, wantOther: 1},
+		{name: "revoked", hostname: "old.example.com:22", key: revokedKey, wantErr: ErrHostKeyRevoked},
+		{name: "revoked for any host", hostname: "new.example.org:22", key: revokedKey, wantErr: ErrHostKeyRevoked},
+		{name: "cert authority is not a host key", hostname: "ca.example.com:22", key: caKey, wantErr: &HostKeyError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := kh.Check(tt.hostname, tt.key)
+			var keyErr *HostKeyError
+			switch {
+			case tt.wantErr == nil:
+				if err != nil {
+					t.Fatalf("got error %v, want none", err)
+				}
+			case errors.Is(tt.wantErr, ErrHostKeyRevoked):
+				if !errors.Is(err, ErrHostKeyRevoked) {
+					t.Fatalf("got error %v, want %v", err, ErrHostKeyRevoked)
+				}
+			case !errors.As(err, &keyErr):
+				t.Fatalf("got error %v, want a host key error", err)
+			default:
+				if keyErr.Changed() != tt.wantChanged {
+					t.Fatalf("changed %v, want %v", keyErr.Changed(), tt.wantChanged)
+				}
+				if tt.wantChanged && (keyErr.Want[0].Filename != path || keyErr.Want[0].Line != tt.wantLine) {
+					t.Errorf("recorded at %s:%d, want %s:%d", keyErr.Want[0].Filename, keyErr.Want[0].Line, path, tt.wantLine)
+				}
+				if len(keyErr.Other) != tt.wantOther {
+					t.Errorf("%d keys of another type, want %d", len(keyErr.Other), tt.wantOther)
+				}
+			}
+		})
+	}
+
+	if !kh.IsRevoked(revokedKey) {
+		t.Error("revoked key not reported")
+	}
+	if kh.IsRevoked(webKey) {
+		t.Error("known key reported as revoked")
+	}
+}
+
+func TestKnownHostsAuthorities(t *testing.T) {
+	var (
+		ca      = newHostKey(t)
+		labCA   = newHostKey(t)
+		hashCA  = newHostKey(t)
+		hostKey = newHostKey(t)
+	)
+	kh := &KnownHosts{}
+	for _, line := range []string{
+		knownHostsLine(markerCertAuthority, "*.example.com,!*.lab.example.com", ca),
+		knownHostsLine(markerCertAuthority, "[*.lab.example.com]:*,*.lab.example.com", labCA),
+		knownHostsLine(markerCertAuthority, hashedHost(t, "vault.example.org"), hashCA),
+		knownHostsLine("", "*.example.com", hostKey),
+		knownHostsLine(markerRevoked, "*.example.com", hostKey),
+	} {
+		entry, ok := parseKnownHostsLine(line)
+		if !ok {
+			t.Fatalf("cannot parse %q", line)
+		}
+		kh.entries = append(kh.entries, entry)
+	}
+
+	tests := []struct {
+		hostname string
+		want     []ssh.PublicKey
+	}{
+		{"www.example.com:22", []ssh.PublicKey{ca}},
+		{"www.example.com:2222", nil},
+		{"node.lab.example.com:22", []ssh.PublicKey{labCA}},
+		{"node.lab.example.com:2222", []ssh.PublicKey{labCA}},
+		{"vault.example.org:22", []ssh.PublicKey{hashCA}},
+		{"example.net:22", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got := kh.Authorities(tt.hostname)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d authorities, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if string(got[i].Key.Marshal()) != string(tt.want[i].Marshal()) {
+					t.Errorf("authority %d is %s, want %s", i, Fingerprint(got[i].Key), Fingerprint(tt.want[i]))
+				}
+			}
+		})
+	}
+}
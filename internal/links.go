@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// What directory transfers do with symbolic links.
+const (
+	// send what links to files point to, leave out links to directories
+	LinksCopy = "copy"
+	// also descend into linked directories
+	LinksFollow = "follow"
+	LinksSkip   = "skip"
+	// recreate the links on the other side
+	LinksPreserve = "preserve"
+)
+
+// maxLinkHops bounds the links resolved for one path, like SYMLOOP_MAX.
+const maxLinkHops = 40
+
+func parseLinkOptions(opts Options) (Options, error) {
+	switch links := strings.ToLower(opts.Links); links {
+	case "":
+		opts.Links = LinksCopy
+	case LinksCopy, LinksFollow, LinksSkip, LinksPreserve:
+		opts.Links = links
+	default:
+		return opts, fmt.Errorf("invalid --links %q (use copy, follow, skip or preserve)", opts.Links)
+	}
+	return opts, nil
+}
+
+// linkInfo describes a symbolic link kept with --links=preserve.
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
+
+// tree is one side of a directory transfer. Paths are slash separated.
+type tree interface {
+	// ReadDir does not follow links
+	ReadDir(dir string) ([]os.FileInfo, error)
+	Stat(p string) (os.FileInfo, error)
+	ReadLink(p string) (string, error)
+	// RealPath resolves every link in p
+	RealPath(p string) (string, error)
+	ReadFile(p string) ([]byte, error)
+}
+
+type localTree struct{}
+
+func (localTree) ReadDir(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(filepath.FromSlash(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+func (localTree) Stat(p string) (os.FileInfo, error) {
+	return os.Stat(filepath.FromSlash(p))
+}
+
+func (localTree) ReadLink(p string) (string, error) {
+	target, err := os.Readlink(filepath.FromSlash(p))
+	return filepath.ToSlash(target), err
+}
+
+func (localTree) RealPath(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(filepath.FromSlash(p))
+	if err != nil {
+		return "", err
+	}
+	real, err = filepath.Abs(real)
+	return filepath.ToSlash(real), err
+}
+
+func (localTree) ReadFile(p string) ([]byte, error) {
+	return os.ReadFile(filepath.FromSlash(p))
+}
+
+type remoteTree struct {
+	pool *Pool
+}
+
+func (t remoteTree) ReadDir(dir string) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := t.pool.Do(func(client *Client) error {
+		var err error
+		entries, err = client.SFTP().ReadDir(dir)
+		return err
+	})
+	return entries, err
+}
+
+func (t remoteTree) Stat(p string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := t.pool.Do(func(client *Client) error {
+		var err error
+		fi, err = client.SFTP().Stat(p)
+		return err
+	})
+	return fi, err
+}
+
+func (t remoteTree) ReadLink(p string) (string, error) {
+	var target string
+	err := t.pool.Do(func(client *Client) error {
+		var err error
+		target, err = client.SFTP().ReadLink(p)
+		return err
+	})
+	return target, err
+}
+
+// RealPath follows a link in the last element itself, since not every
+// server resolves links in SSH_FXP_REALPATH; OpenSSH resolves the rest.
+func (t remoteTree) RealPath(p string) (string, error) {
+	var real string
+	err := t.pool.Do(func(client *Client) error {
+		sftpClient := client.SFTP()
+		p := p
+		for hops := 0; ; hops++ {
+			fi, err := sftpClient.Lstat(p)
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&os.ModeSymlink == 0 {
+				break
+			}
+			if hops == maxLinkHops {
+				return fmt.Errorf("%s: too many levels of symbolic links", p)
+			}
+
+			target, err := sftpClient.ReadLink(p)
+			if err != nil {
+				return err
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(p), target)
+			}
+			p = target
+		}
+
+		var err error
+		real, err = sftpClient.RealPath(p)
+		return err
+	})
+	return real, err
+}
+
+func (t remoteTree) ReadFile(p string) ([]byte, error) {
+	var data []byte
+	err := t.pool.Do(func(client *Client) error {
+		f, err := client.SFTP().Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		data, err = io.ReadAll(f)
+		return err
+	})
+	return data, err
+}
+
+// walkTree calls fn for everything below root that the filters of opts
+// let through, parents first, with rel the path relative to root.
+// Symbolic links are handled as opts.Links says; those resolving outside
+// root, and linked directories that lead back to one being walked, are
+// left out with a warning. fn may return filepath.SkipAll to stop early.
+func walkTree(t tree, root string, opts Options, fn func(p, rel string, fi os.FileInfo) error) error {
+	real, err := t.RealPath(root)
+	if err != nil {
+		return err
+	}
+
+	w := &treeWalk{
+		t:         t,
+		links:     opts.Links,
+		filter:    newFilter(opts),
+		root:      real,
+		fn:        fn,
+		ancestors: make(map[string]bool),
+	}
+	err = w.walk(root, ".", real)
+	if errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+type treeWalk struct {
+	t      tree
+	links  string
+	filter *filter
+	root   string
+	fn     func(p, rel string, fi os.FileInfo) error
+	// real paths of the directories being walked
+	ancestors map[string]bool
+	// rules of the ignore files read on the way down
+	ignores []rule
+}
+
+func (w *treeWalk) walk(dir, rel, real string) error {
+	entries, err := w.t.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	w.ancestors[real] = true
+	defer delete(w.ancestors, real)
+
+	outer := len(w.ignores)
+	w.ignores = append(w.ignores, w.filter.ignoreRules(w.t, dir, rel, entries)...)
+	defer func() { w.ignores = w.ignores[:outer] }()
+
+	for _, fi := range entries {
+		p := path.Join(dir, fi.Name())
+		childRel := path.Join(rel, fi.Name())
+		childReal := path.Join(real, fi.Name())
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			fi, childReal, err = w.link(p, childRel, fi)
+			if err != nil {
+				return err
+			}
+			if fi == nil {
+				continue
+			}
+		}
+
+		if w.filter.excluded(childRel, fi.IsDir(), w.ignores) {
+			continue
+		}
+		if fi.IsDir() && w.ancestors[childReal] {
+			fmt.Fprintf(os.Stderr, "⚠ Skipping %s: link loop back to %s\n", p, childReal)
+			continue
+		}
+		if err := w.fn(p, childRel, fi); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if err := w.walk(p, childRel, childReal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// link returns what to pass on for the symbolic link p, and its real
+// path; nil to leave it out.
+func (w *treeWalk) link(p, rel string, fi os.FileInfo) (os.FileInfo, string, error) {
+	if w.links == LinksSkip {
+		return nil, "", nil
+	}
+
+	if w.links == LinksPreserve {
+		target, err := w.t.ReadLink(p)
+		if err != nil {
+			return nil, "", err
+		}
+		// the copy must resolve the same way without anything outside it
+		if path.IsAbs(target) || !within(".", path.Join(path.Dir(rel), target)) {
+			fmt.Fprintf(os.Stderr, "⚠ Skipping %s: link to %s leaves the transfer root\n", p, target)
+			return nil, "", nil
+		}
+		if real, err := w.t.RealPath(p); err == nil && !within(w.root, real) {
+			fmt.Fprintf(os.Stderr, "⚠ Skipping %s: link to %s leaves the transfer root\n", p, target)
+			return nil, "", nil
+		}
+		return linkInfo{fi, target}, "", nil
+	}
+
+	real, err := w.t.RealPath(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "⚠ Skipping %s: %v\n", p, err)
+		return nil, "", nil
+	}
+	if !within(w.root, real) {
+		fmt.Fprintf(os.Stderr, "⚠ Skipping %s: link to %s leaves the transfer root\n", p, real)
+		return nil, "", nil
+	}
+
+	target, err := w.t.Stat(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "⚠ Skipping %s: %v\n", p, err)
+		return nil, "", nil
+	}
+	if target.IsDir() && w.links == LinksCopy {
+		return nil, "", nil
+	}
+	return target, real, nil
+}
+
+// within reports whether the cleaned slash path p is root or below it.
+func within(root, p string) bool {
+	if root == "." {
+		return p != ".." && !strings.HasPrefix(p, "../")
+	}
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
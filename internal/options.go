@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Options struct {
+	User    string
+	Host    string
+	Port    int
+	KeyPath string
+	Retry   int
+
+	Connections int
+	Sessions    int
+	Stripes     int
+	Verify      string
+	Checksum    string
+	// read back the whole remote .part file before resuming an upload
+	VerifyResume bool
+
+	Preserve      bool
+	PreserveOwner bool
+	NumericIDs    bool
+	Links         string
+	Sparse        bool
+
+	// directory transfers only
+	Include     []string
+	Exclude     []string
+	ExcludeFrom []string
+	IgnoreFiles bool
+
+	// zero means tuned automatically
+	Workers    int
+	BufferSize int
+	PacketSize int
+	Requests   int
+
+	CertificateFiles []string
+
+	PassphraseFile string
+	PasswordStdin  bool
+	AuthOrder      []string
+
+	SSHConfigFile  string
+	ProxyJump      string
+	Proxy          string
+	ProxyCommand   string
+	HashKnownHosts bool
+
+	HostKeyFingerprints []string
+	HostCAFiles         []string
+
+	// filled from ssh_config by resolve unless given as flags
+	IdentityFiles         []string
+	IdentitiesOnly        bool
+	KnownHostsFiles       []string
+	GlobalKnownHostsFiles []string
+	StrictHostKeyChecking string
+	CryptoProfile         string
+	Ciphers               string
+	MACs                  string
+	KexAlgorithms         string
+	HostKeyAlgorithms     string
+}
+
+// parseTransferOptions checks the options of Upload and Download.
+func parseTransferOptions(opts Options) (Options, error) {
+	opts, err := parseVerifyOptions(opts)
+	if err != nil {
+		return opts, err
+	}
+	if opts, err = parseLinkOptions(opts); err != nil {
+		return opts, err
+	}
+	return parseFilterOptions(opts)
+}
+
+// resolve fills every option not given on the command line from
+// ssh_config, then applies the built-in defaults.
+func (o Options) resolve() (Options, error) {
+	paths := DefaultSSHConfigPaths()
+	switch o.SSHConfigFile {
+	case "":
+	case "none":
+		paths = nil
+	default:
+		path := expandHome(o.SSHConfigFile)
+		if _, err := os.Stat(path); err != nil {
+			return o, fmt.Errorf("cannot read ssh config: %w", err)
+		}
+		paths = []string{path}
+	}
+
+	cfg, err := LoadSSHConfig(paths...)
+	if err != nil {
+		return o, fmt.Errorf("cannot parse ssh config: %w", err)
+	}
+	hc := cfg.Resolve(o.Host, o.User)
+
+	o.Host = hc.HostName
+	if o.User == "" {
+		o.User = hc.User
+	}
+	if o.User == "" {
+		o.User = "root"
+	}
+	if o.Port == 0 {
+		o.Port = hc.Port
+	}
+	if o.Port == 0 {
+		o.Port = 22
+	}
+
+	for _, f := range hc.IdentityFiles {
+		o.IdentityFiles = append(o.IdentityFiles, expandTokens(f, o.Host, o.User, o.Port))
+	}
+	o.CertificateFiles = append(append([]string{}, o.CertificateFiles...), o.expandFiles(hc.CertificateFiles)...)
+	o.IdentitiesOnly = o.IdentitiesOnly || hc.IdentitiesOnly
+
+	if len(o.KnownHostsFiles) == 0 {
+		o.KnownHostsFiles = o.expandFiles(hc.UserKnownHostsFiles)
+	}
+	if o.GlobalKnownHostsFiles == nil && hc.GlobalKnownHostsFiles != nil {
+		// "none" leaves an empty, non-nil list which disables global files
+		o.GlobalKnownHostsFiles = append([]string{}, o.expandFiles(hc.GlobalKnownHostsFiles)...)
+	}
+	o.HashKnownHosts = o.HashKnownHosts || hc.HashKnownHosts
+	if o.StrictHostKeyChecking == "" {
+		o.StrictHostKeyChecking = hc.StrictHostKeyChecking
+	}
+	o.StrictHostKeyChecking, err = ParseStrictHostKeyChecking(o.StrictHostKeyChecking)
+	if err != nil {
+		return o, err
+	}
+	if o.ProxyJump == "" && !strings.EqualFold(hc.ProxyJump, "none") {
+		o.ProxyJump = hc.ProxyJump
+	}
+	if o.Proxy == "" && o.ProxyCommand == "" {
+		o.ProxyCommand = hc.ProxyCommand
+	}
+	if o.Ciphers == "" {
+		o.Ciphers = hc.Ciphers
+	}
+	if o.MACs == "" {
+		o.MACs = hc.MACs
+	}
+	if o.KexAlgorithms == "" {
+		o.KexAlgorithms = hc.KexAlgorithms
+	}
+	if o.HostKeyAlgorithms == "" {
+		o.HostKeyAlgorithms = hc.HostKeyAlgorithms
+	}
+
+	return o, nil
+}
+
+func (o Options) expandFiles(files []string) []string {
+	var expanded []string
+	for _, f := range files {
+		if strings.EqualFold(f, "none") {
+			continue
+		}
+		expanded = append(expanded, expandTokens(f, o.Host, o.User, o.Port))
+	}
+	return expanded
+}
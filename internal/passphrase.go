@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const maxPassphraseAttempts = 3
+
+// keyUnlocker decrypts passphrase protected keys, trying GOSCP_PASSPHRASE
+// or --passphrase-file first and falling back to a terminal prompt.
+type keyUnlocker struct {
+	passphrase []byte
+
+	// loaded keys are shared by every hop so each is decrypted once
+	mu      sync.Mutex
+	signers map[string]ssh.Signer
+}
+
+func newKeyUnlocker(passphraseFile string) (*keyUnlocker, error) {
+	u := &keyUnlocker{signers: make(map[string]ssh.Signer)}
+
+	if env := os.Getenv("GOSCP_PASSPHRASE"); env != "" {
+		u.passphrase = []byte(env)
+	}
+
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read passphrase file: %w", err)
+		}
+		u.passphrase = bytes.TrimRight(data, "\r\n")
+	}
+
+	return u, nil
+}
+
+func (u *keyUnlocker) unlock(path string, pem []byte) (ssh.Signer, error) {
+	if u.passphrase != nil {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(pem, u.passphrase)
+		if err == nil {
+			return signer, nil
+		}
+		fmt.Fprintf(os.Stderr, "⚠ Provided passphrase does not decrypt '%s'\n", path)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxPassphraseAttempts; attempt++ {
+		pw, err := readSecret(fmt.Sprintf("Enter passphrase for key '%s': ", path))
+		if err != nil {
+			return nil, fmt.Errorf("key '%s' is passphrase protected: %w", path, err)
+		}
+
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(pem, pw)
+		if err == nil {
+			return signer, nil
+		}
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("cannot decrypt key '%s': %w", path, lastErr)
+}
+
+// loadSigner parses a private key. Encrypted keys whose public half is
+// known (embedded in the file or in a sibling .pub) are returned as a
+// lazySigner so the passphrase is only asked for once the server accepts
+// that public key.
+func (u *keyUnlocker) loadSigner(path string, pem []byte) (ssh.Signer, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if signer, ok := u.signers[path]; ok {
+		return signer, nil
+	}
+
+	signer, err := u.parseSigner(path, pem)
+	if err != nil {
+		return nil, err
+	}
+	u.signers[path] = signer
+	return signer, nil
+}
+
+func (u *keyUnlocker) parseSigner(path string, pem []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, err
+	}
+
+	pub := missing.PublicKey
+	if pub == nil {
+		pub = readPublicKey(path + ".pub")
+	}
+	if pub == nil {
+		return u.unlock(path, pem)
+	}
+
+	return &lazySigner{
+		path:     path,
+		pem:      pem,
+		pub:      pub,
+		unlocker: u,
+	}, nil
+}
+
+func readPublicKey(path string) ssh.PublicKey {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+type lazySigner struct {
+	path     string
+	pem      []byte
+	pub      ssh.PublicKey
+	unlocker *keyUnlocker
+
+	mu     sync.Mutex
+	signer ssh.Signer
+}
+
+func (s *lazySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *lazySigner) decrypted() (ssh.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.signer != nil {
+		return s.signer, nil
+	}
+
+	signer, err := s.unlocker.unlock(s.path, s.pem)
+	if err != nil {
+		return nil, err
+	}
+	s.signer = signer
+	return signer, nil
+}
+
+func (s *lazySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.decrypted()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+func (s *lazySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.decrypted()
+	if err != nil {
+		return nil, err
+	}
+
+	as, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return signer.Sign(rand, data)
+	}
+	return as.SignWithAlgorithm(rand, data, algorithm)
+}
@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultConnections = 1
+	DefaultSessions    = 4
+
+	// sessions idle for longer are checked before being leased again
+	poolIdleCheck   = 30 * time.Second
+	poolPingTimeout = 5 * time.Second
+)
+
+var ErrPoolClosed = errors.New("connection pool closed")
+
+// Pool leases SFTP sessions spread over several SSH connections, so that
+// parallel transfers are not limited by the window of a single channel or
+// the throughput of a single TCP connection. Connections are opened on
+// demand; dead sessions and connections are replaced transparently.
+type Pool struct {
+	ep       *Endpoint
+	maxConns int
+	perConn  int
+	slots    chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	conns    []*pooledConn
+	idle     []*pooledSession
+	leased   map[*Client]*pooledSession
+	dialing  int
+	closed   bool
+	degraded bool
+}
+
+type pooledConn struct {
+	client *Client
+	open   int
+	// the server refused further channels (sshd MaxSessions)
+	full bool
+	dead bool
+}
+
+type pooledSession struct {
+	client   *Client
+	conn     *pooledConn
+	lastUsed time.Time
+	suspect  bool
+}
+
+// NewPool opens the first connection right away, so unreachable or
+// misconfigured hosts fail before any transfer starts.
+func NewPool(ep *Endpoint, connections, sessions int) (*Pool, error) {
+	if connections <= 0 {
+		connections = DefaultConnections
+	}
+	if sessions <= 0 {
+		sessions = DefaultSessions
+	}
+
+	p := &Pool{
+		ep:       ep,
+		maxConns: connections,
+		perConn:  sessions,
+		slots:    make(chan struct{}, connections*sessions),
+		leased:   make(map[*Client]*pooledSession),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	client, err := ep.Connect()
+	if err != nil {
+		return nil, err
+	}
+	pc := &pooledConn{client: client, open: 1}
+	p.conns = append(p.conns, pc)
+	p.idle = append(p.idle, &pooledSession{client: client, conn: pc, lastUsed: time.Now()})
+	go p.watch(pc)
+	return p, nil
+}
+
+// Size is the number of sessions that can be leased at the same time.
+func (p *Pool) Size() int {
+	return cap(p.slots)
+}
+
+// Get leases a session, blocking while all of them are in use. Every
+// session obtained from Get must be handed back with Put.
+func (p *Pool) Get() (*Client, error) {
+	p.slots <- struct{}{}
+
+	s, err := p.lease()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.leased[s.client] = s
+	p.mu.Unlock()
+	return s.client, nil
+}
+
+// Put returns a leased session. A non-nil err marks it for a health check
+// before its next use.
+func (p *Pool) Put(client *Client, err error) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.leased[client]
+	if !ok {
+		return
+	}
+	delete(p.leased, client)
+
+	if p.closed {
+		s.client.sftp.Close()
+		return
+	}
+
+	s.lastUsed = time.Now()
+	s.suspect = err != nil
+	p.idle = append(p.idle, s)
+	p.cond.Broadcast()
+}
+
+// Do runs fn with a leased session.
+func (p *Pool) Do(fn func(*Client) error) error {
+	client, err := p.Get()
+	if err != nil {
+		return err
+	}
+
+	err = fn(client)
+	p.Put(client, err)
+	return err
+}
+
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, s := range p.idle {
+		s.client.sftp.Close()
+	}
+	p.idle = nil
+
+	var err error
+	for _, pc := range p.conns {
+		if cerr := pc.client.Close(); cerr != nil && err == nil && !pc.dead {
+			err = cerr
+		}
+	}
+	p.conns = nil
+	p.cond.Broadcast()
+	return err
+}
+
+func (p *Pool) lease() (*pooledSession, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		// reuse the most recently returned session first
+		if n := len(p.idle); n > 0 {
+			s := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+
+			if p.healthy(s) {
+				return s, nil
+			}
+			p.discard(s)
+			continue
+		}
+
+		// spread sessions over connections before sharing one
+		if p.liveConns()+p.dialing < p.maxConns {
+			p.dialing++
+			p.mu.Unlock()
+
+			s, err := p.dial()
+			if err != nil {
+				return nil, err
+			}
+			if s != nil {
+				return s, nil
+			}
+			continue
+		}
+
+		// then open another channel on a connection with room for it
+		if pc := p.roomyConn(); pc != nil {
+			pc.open++
+			p.mu.Unlock()
+
+			s, err := p.openSession(pc)
+			if err != nil {
+				p.mu.Lock()
+				pc.open--
+				pc.full = true
+				p.degrade(fmt.Sprintf("cannot open more than %d sessions per connection", pc.open), err)
+				p.mu.Unlock()
+				continue
+			}
+			return s, nil
+		}
+
+		// wait for a session to come back or a dial to finish
+		p.cond.Wait()
+		p.mu.Unlock()
+	}
+}
+
+// roomyConn returns the least busy connection that can take a channel.
+func (p *Pool) roomyConn() *pooledConn {
+	var best *pooledConn
+	for _, pc := range p.conns {
+		if pc.dead || pc.full || pc.open >= p.perConn {
+			continue
+		}
+		if best == nil || pc.open < best.open {
+			best = pc
+		}
+	}
+	return best
+}
+
+// dial opens one more connection. When the server refuses it but other
+// connections are alive, it returns no session and no error and the pool
+// carries on with the connections it has.
+func (p *Pool) dial() (*pooledSession, error) {
+	client, err := p.ep.Connect()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	p.cond.Broadcast()
+
+	if err != nil {
+		if p.liveConns() == 0 {
+			return nil, err
+		}
+		// the server may limit unauthenticated connections (MaxStartups)
+		p.maxConns = p.liveConns()
+		p.degrade(fmt.Sprintf("cannot open more than %d connections", p.maxConns), err)
+		return nil, nil
+	}
+
+	if p.closed {
+		client.Close()
+		return nil, ErrPoolClosed
+	}
+
+	pc := &pooledConn{client: client, open: 1}
+	p.conns = append(p.conns, pc)
+	go p.watch(pc)
+	return &pooledSession{client: client, conn: pc, lastUsed: time.Now()}, nil
+}
+
+// openSession starts an additional SFTP channel on an existing connection.
+func (p *Pool) openSession(pc *pooledConn) (*pooledSession, error) {
+	client := &Client{Client: pc.client.Client, tuning: pc.client.tuning, conn: pc.client.conn}
+	sftpClient, err := newSFTP(client)
+	if err != nil {
+		return nil, err
+	}
+	client.sftp = sftpClient
+	return &pooledSession{
+		client:   client,
+		conn:     pc,
+		lastUsed: time.Now(),
+	}, nil
+}
+
+// healthy checks sessions that failed last time or sat idle for a while:
+// a keepalive on the connection, then a round trip on the SFTP channel.
+func (p *Pool) healthy(s *pooledSession) bool {
+	p.mu.Lock()
+	dead := s.conn.dead
+	p.mu.Unlock()
+	if dead {
+		return false
+	}
+
+	if !s.suspect && time.Since(s.lastUsed) < poolIdleCheck {
+		return true
+	}
+
+	if err := ping(s.conn.client); err != nil {
+		p.mu.Lock()
+		if !s.conn.dead {
+			s.conn.dead = true
+			s.conn.client.Close()
+		}
+		p.mu.Unlock()
+		return false
+	}
+
+	if _, err := s.client.sftp.Getwd(); err != nil {
+		return false
+	}
+	s.suspect = false
+	return true
+}
+
+// discard closes a broken session and forgets its connection once the
+// last session on it is gone.
+func (p *Pool) discard(s *pooledSession) {
+	if s.client != nil {
+		s.client.sftp.Close()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.conn.open--
+	if s.conn.open <= 0 {
+		for i, pc := range p.conns {
+			if pc == s.conn {
+				p.conns = append(p.conns[:i], p.conns[i+1:]...)
+				break
+			}
+		}
+		// also tears down the jump hosts behind it
+		s.conn.dead = true
+		s.conn.client.Close()
+	}
+	p.cond.Broadcast()
+}
+
+// watch marks a connection dead as soon as it drops, so its sessions are
+// replaced instead of handed out again.
+func (p *Pool) watch(pc *pooledConn) {
+	pc.client.Wait()
+
+	p.mu.Lock()
+	pc.dead = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// degrade warns once that the pool runs with fewer sessions than asked.
+func (p *Pool) degrade(reason string, err error) {
+	if p.degraded {
+		return
+	}
+	p.degraded = true
+	fmt.Fprintf(os.Stderr, "⚠ %s, continuing with fewer: %v\n", reason, err)
+}
+
+func (p *Pool) liveConns() int {
+	n := 0
+	for _, pc := range p.conns {
+		if !pc.dead {
+			n++
+		}
+	}
+	return n
+}
+
+func ping(client *Client) error {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(poolPingTimeout):
+		return fmt.Errorf("keepalive timed out")
+	}
+}
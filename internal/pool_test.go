@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer is an SSH server with an in-memory SFTP subsystem. Like sshd
+// with MaxSessions, it refuses channels past maxSessions per connection
+// when maxSessions is positive.
+type sftpServer struct {
+	addr        string
+	maxSessions int
+	dials       atomic.Int32
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+	// most channels open at once on a connection
+	peak int
+}
+
+func newSFTPServer(t *testing.T, maxSessions int) *sftpServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &sftpServer{addr: l.Addr().String(), maxSessions: maxSessions}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, cfg)
+		}
+	}()
+	return s
+}
+
+func (s *sftpServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	s.dials.Add(1)
+	s.mu.Lock()
+	s.conns = append(s.conns, sconn)
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+
+	var open atomic.Int32
+	for nc := range chans {
+		// sshd handles the close of a channel before the next open; here
+		// the goroutine of a closed channel may still be finishing
+		for i := 0; s.maxSessions > 0 && int(open.Load()) >= s.maxSessions && i < 50; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if s.maxSessions > 0 && int(open.Load()) >= s.maxSessions {
+			nc.Reject(ssh.ResourceShortage, "no more sessions")
+			continue
+		}
+		ch, in, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		n := open.Add(1)
+		s.mu.Lock()
+		s.peak = max(s.peak, int(n))
+		s.mu.Unlock()
+
+		go func() {
+			defer ch.Close()
+			// counted until the channel is closed
+			defer open.Add(-1)
+			for req := range in {
+				if req.Type != "subsystem" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				sftp.NewRequestServer(ch, sftp.InMemHandler()).Serve()
+				return
+			}
+		}()
+	}
+}
+
+// drop closes every connection from the server side.
+func (s *sftpServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sftpServer) pool(t *testing.T, connections, sessions int) *Pool {
+	t.Helper()
+	ep := &Endpoint{
+		Addr: s.addr,
+		Config: &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+		auth:   &authTracker{},
+		dialer: directDialer(),
+	}
+	p, err := NewPool(ep, connections, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPoolLease(t *testing.T) {
+	tests := []struct {
+		name        string
+		connections int
+		sessions    int
+		maxSessions int
+		// sessions leased at the same time
+		leases       int
+		wantConns    int
+		wantDegraded bool
+	}{
+		{name: "one session", connections: 1, sessions: 1, leases: 1, wantConns: 1},
+		{name: "sessions share a connection", connections: 1, sessions: 4, leases: 4, wantConns: 1},
+		{name: "connections before sessions", connections: 3, sessions: 2, leases: 3, wantConns: 3},
+		{name: "all slots", connections: 2, sessions: 2, leases: 4, wantConns: 2},
+		{name: "server refuses sessions", connections: 1, sessions: 4, maxSessions: 2, leases: 4, wantConns: 1, wantDegraded: true},
+		{name: "single session server", connections: 1, sessions: 2, maxSessions: 1, leases: 2, wantConns: 1, wantDegraded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSFTPServer(t, tt.maxSessions)
+			p := srv.pool(t, tt.connections, tt.sessions)
+			if got, want := p.Size(), tt.connections*tt.sessions; got != want {
+				t.Fatalf("size %d, want %d", got, want)
+			}
+
+			// hold the sessions at once; past what the server allows they
+			// wait for each other
+			var (
+				mu     sync.Mutex
+				leased = make(map[*Client]bool)
+				conns  = make(map[*ssh.Client]bool)
+				wg     sync.WaitGroup
+				start  = make(chan struct{})
+			)
+			for i := 0; i < tt.leases; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					client, err := p.Get()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					if leased[client] {
+						t.Error("session leased twice")
+					}
+					leased[client] = true
+					conns[client.Client] = true
+					mu.Unlock()
+
+					if _, err := client.SFTP().Getwd(); err != nil {
+						t.Error(err)
+					}
+					time.Sleep(20 * time.Millisecond)
+
+					mu.Lock()
+					delete(leased, client)
+					mu.Unlock()
+					p.Put(client, nil)
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			if len(conns) != tt.wantConns {
+				t.Errorf("used %d connections, want %d", len(conns), tt.wantConns)
+			}
+			if got := int(srv.dials.Load()); got != tt.wantConns {
+				t.Errorf("dialed %d connections, want %d", got, tt.wantConns)
+			}
+			srv.mu.Lock()
+			peak := srv.peak
+			srv.mu.Unlock()
+			if tt.maxSessions > 0 && peak != tt.maxSessions {
+				t.Errorf("at most %d sessions on a connection, want %d", peak, tt.maxSessions)
+			}
+			if p.degraded != tt.wantDegraded {
+				t.Errorf("degraded %v, want %v", p.degraded, tt.wantDegraded)
+			}
+		})
+	}
+}
+
+func TestPoolReplace(t *testing.T) {
+	srv := newSFTPServer(t, 0)
+	p := srv.pool(t, 1, 2)
+
+	client, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(client, nil)
+
+	srv.drop()
+	// wait for the pool to notice
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		dead := p.conns[0].dead
+		p.mu.Unlock()
+		if dead {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dropped connection not noticed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	replaced, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Put(replaced, nil)
+	if replaced.Client == client.Client {
+		t.Fatal("session of the dropped connection leased again")
+	}
+	if _, err := replaced.SFTP().Getwd(); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dials.Load(); got != 2 {
+		t.Fatalf("dialed %d connections, want 2", got)
+	}
+}
+
+func TestPoolHealthy(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(srv *sftpServer, p *Pool, s *pooledSession)
+		want  bool
+		// the connection is given up
+		wantDead bool
+	}{
+		{
+			name:  "recently used",
+			setup: func(srv *sftpServer, p *Pool, s *pooledSession) {},
+			want:  true,
+		},
+		{
+			name:  "failed last time",
+			setup: func(srv *sftpServer, p *Pool, s *pooledSession) { s.suspect = true },
+			want:  true,
+		},
+		{
+			name:  "idle for long",
+			setup: func(srv *sftpServer, p *Pool, s *pooledSession) { s.lastUsed = time.Now().Add(-2 * poolIdleCheck) },
+			want:  true,
+		},
+		{
+			name: "connection known dead",
+			setup: func(srv *sftpServer, p *Pool, s *pooledSession) {
+				p.mu.Lock()
+				s.conn.dead = true
+				p.mu.Unlock()
+			},
+			want:     false,
+			wantDead: true,
+		},
+		{
+			name: "sftp channel closed",
+			setup: func(srv *sftpServer, p *Pool, s *pooledSession) {
+				s.suspect = true
+				s.client.sftp.Close()
+			},
+			want: false,
+		},
+		{
+			name: "sftp channel closed but not checked",
+			setup: func(srv *sftpServer, p *Pool, s *pooledSession) {
+				s.client.sftp.Close()
+			},
+			want: true,
+		},
+		{
+			name: "connection dropped",
+			setup: func(srv *sftpServer, p *Pool, s *pooledSession) {
+				s.suspect = true
+				// closed under the pool, before watch sees it
+				s.conn.client.Client.Conn.Close()
+			},
+			want:     false,
+			wantDead: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSFTPServer(t, 0)
+			p := srv.pool(t, 1, 1)
+			s := p.idle[0]
+
+			tt.setup(srv, p, s)
+			if got := p.healthy(s); got != tt.want {
+				t.Fatalf("healthy %v, want %v", got, tt.want)
+			}
+			if tt.want && s.suspect {
+				t.Error("still suspect after passing the check")
+			}
+			p.mu.Lock()
+			dead := s.conn.dead
+			p.mu.Unlock()
+			if dead != tt.wantDead {
+				t.Errorf("connection dead %v, want %v", dead, tt.wantDead)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// preserveModeBits are the mode bits carried over with --preserve.
+const preserveModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+func (o Options) preserve() bool {
+	return o.Preserve || o.PreserveOwner
+}
+
+// ownerWarning reports once that ownership cannot be set, usually because
+// only root may give files away.
+var ownerWarning sync.Once
+
+func warnOwner(err error) {
+	ownerWarning.Do(func() {
+		fmt.Fprintf(os.Stderr, "⚠ Cannot preserve ownership, keeping the default owner: %v\n", err)
+	})
+}
+
+// preserveRemote gives the uploaded remotePath the mode, times and, with
+// --owner, the owner of the local file described by fi.
+func preserveRemote(client *Client, opts Options, fi os.FileInfo, remotePath string) error {
+	if !opts.preserve() {
+		return nil
+	}
+	sftpClient := client.SFTP()
+
+	if opts.PreserveOwner {
+		if uid, gid, ok := fileOwner(fi); !ok {
+			warnOwner(fmt.Errorf("file owners are not available on this system"))
+		} else {
+			if !opts.NumericIDs {
+				uid = remoteOwnerID(client, false, localOwnerName(false, uid), uid)
+				gid = remoteOwnerID(client, true, localOwnerName(true, gid), gid)
+			}
+			if err := sftpClient.Chown(remotePath, int(uid), int(gid)); err != nil {
+				warnOwner(err)
+			}
+		}
+	}
+
+	// after chown, which may clear the setuid and setgid bits
+	if err := sftpClient.Chmod(remotePath, fi.Mode()&preserveModeBits); err != nil {
+		return fmt.Errorf("cannot preserve mode of %s: %w", remotePath, err)
+	}
+	if err := sftpClient.Chtimes(remotePath, fileAtime(fi), fi.ModTime()); err != nil {
+		return fmt.Errorf("cannot preserve times of %s: %w", remotePath, err)
+	}
+	return nil
+}
+
+// preserveLocal is the download counterpart of preserveRemote, fi
+// describing the remote file.
+func preserveLocal(client *Client, opts Options, fi os.FileInfo, localPath string) error {
+	if !opts.preserve() {
+		return nil
+	}
+
+	atime := fi.ModTime()
+	stat, ok := fi.Sys().(*sftp.FileStat)
+	if ok {
+		atime = time.Unix(int64(stat.Atime), 0)
+	}
+
+	if opts.PreserveOwner && ok {
+		uid, gid := stat.UID, stat.GID
+		if !opts.NumericIDs {
+			uid = localOwnerID(false, remoteOwnerName(client, false, uid), uid)
+			gid = localOwnerID(true, remoteOwnerName(client, true, gid), gid)
+		}
+		if err := os.Chown(localPath, int(uid), int(gid)); err != nil {
+			warnOwner(err)
+		}
+	}
+
+	if err := os.Chmod(localPath, fi.Mode()&preserveModeBits); err != nil {
+		return fmt.Errorf("cannot preserve mode of %s: %w", localPath, err)
+	}
+	if err := os.Chtimes(localPath, atime, fi.ModTime()); err != nil {
+		return fmt.Errorf("cannot preserve times of %s: %w", localPath, err)
+	}
+	return nil
+}
+
+// dirAttrs remembers directories of a tree transfer, so their mode and
+// times are set once every file inside is written.
+type dirAttrs struct {
+	mu   sync.Mutex
+	dirs []dirAttr
+}
+
+type dirAttr struct {
+	path string
+	fi   os.FileInfo
+}
+
+func (d *dirAttrs) add(path string, fi os.FileInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dirs = append(d.dirs, dirAttr{path, fi})
+}
+
+// apply runs fn deepest directory first, so setting the times of a
+// directory does not touch those of its parent again.
+func (d *dirAttrs) apply(fn func(path string, fi os.FileInfo) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		if err := fn(d.dirs[i].path, d.dirs[i].fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func localOwnerName(group bool, id uint32) string {
+	if group {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(id), 10)); err == nil {
+			return g.Name
+		}
+		return ""
+	}
+	if u, err := user.LookupId(strconv.FormatUint(uint64(id), 10)); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// localOwnerID returns the local id of name, or fallback when there is no
+// such user or group.
+func localOwnerID(group bool, name string, fallback uint32) uint32 {
+	if name == "" {
+		return fallback
+	}
+
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return fallback
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return fallback
+		}
+		id = u.Uid
+	}
+
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return fallback
+	}
+	return uint32(n)
+}
+
+type ownerKey struct {
+	group bool
+	key   string
+}
+
+// remoteLookup caches names and ids looked up on the server, "" when
+// unknown there.
+func remoteLookup(client *Client, group bool, key string, lookup func() string) string {
+	conn, k := client.conn, ownerKey{group, key}
+	conn.mu.Lock()
+	v, ok := conn.owners[k]
+	conn.mu.Unlock()
+	if ok {
+		return v
+	}
+
+	v = lookup()
+	conn.mu.Lock()
+	if conn.owners == nil {
+		conn.owners = make(map[ownerKey]string)
+	}
+	conn.owners[k] = v
+	conn.mu.Unlock()
+	return v
+}
+
+// remoteOwnerID returns the id of name on the server, or fallback.
+func remoteOwnerID(client *Client, group bool, name string, fallback uint32) uint32 {
+	if name == "" {
+		return fallback
+	}
+
+	id := remoteLookup(client, group, name, func() string {
+		entry := getent(client, group, name)
+		if len(entry) < 3 {
+			return ""
+		}
+		return entry[2]
+	})
+
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return fallback
+	}
+	return uint32(n)
+}
+
+// remoteOwnerName returns the name of id on the server, "" if unknown.
+// users-groups-by-id@openssh.com answers without a shell, getent is the
+// fallback.
+func remoteOwnerName(client *Client, group bool, id uint32) string {
+	key := strconv.FormatUint(uint64(id), 10)
+	return remoteLookup(client, group, "#"+key, func() string {
+		if _, ok := client.SFTP().HasExtension("users-groups-by-id@openssh.com"); ok {
+			if name, err := usersGroupsByID(client, group, id); err == nil && name != "" {
+				return name
+			}
+		}
+
+		entry := getent(client, group, key)
+		if len(entry) < 1 {
+			return ""
+		}
+		return entry[0]
+	})
+}
+
+func usersGroupsByID(client *Client, group bool, id uint32) (string, error) {
+	ext, err := client.ext()
+	if err != nil {
+		return "", err
+	}
+
+	// a string of packed uids, then one of packed gids
+	ids := string(binary.BigEndian.AppendUint32(nil, id))
+	var payload []byte
+	if group {
+		payload = appendString(appendString(nil, ""), ids)
+	} else {
+		payload = appendString(appendString(nil, ids), "")
+	}
+
+	reply, err := ext.extended("users-groups-by-id@openssh.com", payload)
+	if err != nil {
+		return "", err
+	}
+
+	// a string of user names, then one of group names, each a sequence
+	// of strings
+	users, rest, err := readString(reply)
+	if err != nil {
+		return "", err
+	}
+	names := users
+	if group {
+		if names, _, err = readString(rest); err != nil {
+			return "", err
+		}
+	}
+	name, _, err := readString([]byte(names))
+	return name, err
+}
+
+// getent returns the fields of the passwd or group entry for key, a name
+// or a numeric id, nil when the server has none or no shell.
+func getent(client *Client, group bool, key string) []string {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil
+	}
+	defer session.Close()
+
+	database := "passwd"
+	if group {
+		database = "group"
+	}
+	output, err := session.Output(fmt.Sprintf("getent %s %s", database, shellQuote(key)))
+	if err != nil {
+		return nil
+	}
+
+	line, _, _ := strings.Cut(string(output), "\n")
+	return strings.Split(line, ":")
+}
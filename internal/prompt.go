@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+var ErrNoTTY = errors.New("no terminal available for interactive prompt")
+
+// promptMu serializes every interactive question so concurrent
+// connections never interleave their prompts on the terminal.
+var promptMu sync.Mutex
+
+func openTTY() (*os.File, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err == nil {
+		return tty, nil
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return os.Stdin, nil
+	}
+	return nil, ErrNoTTY
+}
+
+// readSecret prints the prompt and reads a line from the terminal
+// without echoing it.
+func readSecret(prompt string) ([]byte, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	tty, err := openTTY()
+	if err != nil {
+		return nil, err
+	}
+	if tty != os.Stdin {
+		defer tty.Close()
+	}
+
+	fmt.Fprint(tty, prompt)
+	secret, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read from terminal: %w", err)
+	}
+	return secret, nil
+}
+
+// readLine prints the prompt and reads an echoed line from the terminal.
+func readLine(prompt string) (string, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	tty, err := openTTY()
+	if err != nil {
+		return "", err
+	}
+	if tty != os.Stdin {
+		defer tty.Close()
+	}
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("cannot read from terminal: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
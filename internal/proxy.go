@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// NewProxyDialer returns a dialer that reaches the SSH server through the
+// proxy described by rawURL: socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port (HTTP CONNECT).
+func NewProxyDialer(rawURL string, forward Dialer) (Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: missing host", rawURL)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		return proxy.SOCKS5("tcp", u.Host, auth, forward)
+	case "http":
+		return &httpConnectDialer{proxyAddr: u.Host, user: u.User, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use socks5 or http)", u.Scheme)
+	}
+}
+
+type httpConnectDialer struct {
+	proxyAddr string
+	user      *url.Userinfo
+	forward   Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach http proxy: %w", err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	conn.SetDeadline(time.Now().Add(defaultConnTimeout * 3))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy request failed: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy response failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the server may already have sent its banner after the response
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// proxyCommandDialer runs an ssh_config style ProxyCommand and talks to
+// the server over the command's stdin and stdout.
+type proxyCommandDialer struct {
+	command string
+	user    string
+}
+
+func (d *proxyCommandDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	command := strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%p", port,
+		"%r", d.user,
+		"%n", host,
+	).Replace(d.command)
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start proxy command: %w", err)
+	}
+
+	return &commandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		addr:   commandAddr(command),
+	}, nil
+}
+
+type commandAddr string
+
+func (a commandAddr) Network() string { return "proxycommand" }
+func (a commandAddr) String() string  { return string(a) }
+
+// commandConn adapts a subprocess to net.Conn. Deadlines are not
+// supported by pipes to a child process and are ignored.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   commandAddr
+
+	once     sync.Once
+	waitOnce sync.Once
+	waitErr  error
+}
+
+// Read reports why the command ended when it closes its output with a
+// failure, rather than a bare EOF.
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		if werr := c.wait(); werr != nil {
+			return n, fmt.Errorf("proxy command exited: %w", werr)
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+func (c *commandConn) wait() error {
+	c.waitOnce.Do(func() {
+		c.waitErr = c.cmd.Wait()
+	})
+	return c.waitErr
+}
+
+func (c *commandConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		if c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+		c.wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return c.addr }
+func (c *commandConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// baseDialer picks how the first connection leaves this machine.
+func baseDialer(opts Options) (Dialer, error) {
+	command := opts.ProxyCommand
+	if strings.EqualFold(command, "none") {
+		command = ""
+	}
+
+	switch {
+	case opts.Proxy != "" && command != "":
+		return nil, fmt.Errorf("--proxy and ProxyCommand cannot be used together")
+	case opts.Proxy != "":
+		return NewProxyDialer(opts.Proxy, directDialer())
+	case command != "":
+		return &proxyCommandDialer{command: command, user: opts.User}, nil
+	default:
+		return directDialer(), nil
+	}
+}
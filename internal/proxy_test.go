@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testBanner = "SSH-2.0-fake"
+
+// serveFake accepts connections on a local listener and hands each to
+// handle. It returns the listener's address.
+func serveFake(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveTarget stands in for the SSH server: it sends a banner and echoes
+// what it reads.
+func serveTarget(t *testing.T) string {
+	return serveFake(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "%s\r\n", testBanner)
+		io.Copy(conn, conn)
+	})
+}
+
+// splice connects conn to addr and copies both ways until either ends.
+func splice(conn net.Conn, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// serveSOCKS5 is a SOCKS5 proxy for CONNECT requests. With user set it
+// asks for username/password authentication; reply is the status sent
+// for the request, 0 for success.
+func serveSOCKS5(t *testing.T, user, password string, reply byte) string {
+	return serveFake(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+
+		var greeting [2]byte
+		if _, err := io.ReadFull(r, greeting[:]); err != nil || greeting[0] != 5 {
+			return
+		}
+		if _, err := io.ReadFull(r, make([]byte, greeting[1])); err != nil {
+			return
+		}
+		if user == "" {
+			conn.Write([]byte{5, 0})
+		} else {
+			conn.Write([]byte{5, 2})
+			if version, err := r.ReadByte(); err != nil || version != 1 {
+				return
+			}
+			gotUser, gotPassword := readSOCKSField(r), readSOCKSField(r)
+			if string(gotUser) != user || string(gotPassword) != password {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		var request [4]byte
+		if _, err := io.ReadFull(r, request[:]); err != nil || request[1] != 1 {
+			return
+		}
+		var host string
+		switch request[3] {
+		case 1:
+			ip := make([]byte, 4)
+			if _, err := io.ReadFull(r, ip); err != nil {
+				return
+			}
+			host = net.IP(ip).String()
+		case 3:
+			name := readSOCKSField(r)
+			if name == nil {
+				return
+			}
+			host = string(name)
+		default:
+			return
+		}
+		var port [2]byte
+		if _, err := io.ReadFull(r, port[:]); err != nil {
+			return
+		}
+
+		conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+		if reply != 0 {
+			return
+		}
+		splice(conn, net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port[:]))))
+	})
+}
+
+// readSOCKSField reads a length prefixed field.
+func readSOCKSField(r *bufio.Reader) []byte {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil
+	}
+	return field
+}
+
+// serveHTTPConnect is an HTTP proxy answering CONNECT with status. With
+// user set it requires those Basic credentials.
+func serveHTTPConnect(t *testing.T, user, password string, status int) string {
+	return serveFake(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if user != "" {
+			want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+			if req.Header.Get("Proxy-Authorization") != want {
+				status = http.StatusProxyAuthRequired
+			}
+		}
+
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+		if status != http.StatusOK {
+			return
+		}
+		splice(conn, req.Host)
+	})
+}
+
+func TestProxyDialers(t *testing.T) {
+	target := serveTarget(t)
+
+	tests := []struct {
+		name   string
+		dialer func(t *testing.T) Dialer
+		addr   string
+		// the line read first through the connection
+		want string
+		// part of the error from dialing or reading
+		wantErr string
+	}{
+		{
+			name:   "socks5",
+			dialer: proxyURL("socks5://%s", serveSOCKS5(t, "", "", 0)),
+			addr:   target,
+			want:   testBanner,
+		},
+		{
+			name:   "socks5 with authentication",
+			dialer: proxyURL("socks5://alice:secret@%s", serveSOCKS5(t, "alice", "secret", 0)),
+			addr:   target,
+			want:   testBanner,
+		},
+		{
+			name:    "socks5 connection refused",
+			dialer:  proxyURL("socks5://%s", serveSOCKS5(t, "", "", 5)),
+			addr:    target,
+			wantErr: "connection refused",
+		},
+		{
+			name:   "http connect",
+			dialer: proxyURL("http://%s", serveHTTPConnect(t, "", "", http.StatusOK)),
+			addr:   target,
+			want:   testBanner,
+		},
+		{
+			name:   "http connect with authentication",
+			dialer: proxyURL("http://alice:secret@%s", serveHTTPConnect(t, "alice", "secret", http.StatusOK)),
+			addr:   target,
+			want:   testBanner,
+		},
+		{
+			name:    "http connect refused",
+			dialer:  proxyURL("http://%s", serveHTTPConnect(t, "", "", http.StatusForbidden)),
+			addr:    target,
+			wantErr: "http proxy refused CONNECT to " + target + ": 403 Forbidden",
+		},
+		{
+			name:    "http connect wrong credentials",
+			dialer:  proxyURL("http://alice:wrong@%s", serveHTTPConnect(t, "alice", "secret", http.StatusOK)),
+			addr:    target,
+			wantErr: "407 Proxy Authentication Required",
+		},
+		{
+			name: "proxy command",
+			dialer: func(t *testing.T) Dialer {
+				return &proxyCommandDialer{command: "echo 'SSH-2.0-%r@%h:%p%%'; cat", user: "alice"}
+			},
+			addr: "example.com:2222",
+			want: "SSH-2.0-alice@example.com:2222%",
+		},
+		{
+			name: "proxy command exits early",
+			dialer: func(t *testing.T) Dialer {
+				return &proxyCommandDialer{command: "exit 3"}
+			},
+			addr:    "example.com:22",
+			wantErr: "proxy command exited: exit status 3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dialAndGreet(tt.dialer(t), tt.addr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// proxyURL returns a dialer for the proxy URL format filled with addr.
+func proxyURL(format, addr string) func(t *testing.T) Dialer {
+	return func(t *testing.T) Dialer {
+		t.Helper()
+		d, err := NewProxyDialer(fmt.Sprintf(format, addr), directDialer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+}
+
+// dialAndGreet dials addr through d, reads the first line and checks
+// that what is written next comes back.
+func dialAndGreet(d Dialer, addr string) (string, error) {
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		return "", err
+	}
+	echo, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if echo != "ping\n" {
+		return "", fmt.Errorf("echo %q, want %q", echo, "ping\n")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrNoHost = errors.New("no remote host given (use -H or [user@]host:path)")
+
+// RemoteSpec is a parsed "[user@]host[:port]:path" argument.
+type RemoteSpec struct {
+	User string
+	Host string
+	Port int
+	Path string
+}
+
+// ParseRemote parses an scp-style remote argument. It reports false when
+// arg is a local path, which is the case when there is no ':' or a '/'
+// comes before the first ':'. IPv6 hosts must be bracketed.
+func ParseRemote(arg string) (RemoteSpec, bool, error) {
+	var spec RemoteSpec
+
+	rest := arg
+	hasUser := false
+	if at := strings.Index(rest, "@"); at >= 0 && !strings.ContainsAny(rest[:at], "/:[") {
+		spec.User, hasUser = rest[:at], true
+		rest = rest[at+1:]
+	}
+
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return spec, false, fmt.Errorf("missing ']' in %q", arg)
+		}
+		spec.Host = rest[1:end]
+		rest = rest[end+1:]
+		if !strings.HasPrefix(rest, ":") {
+			return spec, false, fmt.Errorf("missing ':' after host in %q", arg)
+		}
+		rest = rest[1:]
+	} else {
+		colon := strings.Index(rest, ":")
+		if colon <= 0 || strings.Contains(rest[:colon], "/") {
+			return RemoteSpec{}, false, nil
+		}
+		spec.Host = rest[:colon]
+		rest = rest[colon+1:]
+	}
+
+	if spec.Host == "" {
+		return spec, false, fmt.Errorf("empty host in %q", arg)
+	}
+	if hasUser && spec.User == "" {
+		return spec, false, fmt.Errorf("empty user in %q", arg)
+	}
+
+	// an all-digit segment followed by ':' is the port
+	if colon := strings.Index(rest, ":"); colon > 0 {
+		if port, err := strconv.Atoi(rest[:colon]); err == nil {
+			if port <= 0 || port > 65535 {
+				return spec, false, fmt.Errorf("invalid port %d in %q", port, arg)
+			}
+			spec.Port = port
+			rest = rest[colon+1:]
+		}
+	}
+
+	spec.Path = rest
+	if spec.Path == "" {
+		spec.Path = "."
+	}
+	return spec, true, nil
+}
+
+// apply overrides the connection options with the values given in the
+// argument itself.
+func (s RemoteSpec) apply(opts Options) Options {
+	opts.Host = s.Host
+	if s.User != "" {
+		opts.User = s.User
+	}
+	if s.Port != 0 {
+		opts.Port = s.Port
+	}
+	return opts
+}
+
+// remoteArg lets upload and download take "host:path" when no -H is set.
+func remoteArg(opts Options, arg string) (Options, string) {
+	if opts.Host != "" {
+		return opts, arg
+	}
+
+	spec, ok, err := ParseRemote(arg)
+	if err != nil {
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
+	if !ok {
+		return opts, arg
+	}
+	return spec.apply(opts), spec.Path
+}
+
+// Copy infers the transfer direction from which argument is remote.
+func Copy(opts Options, src, dst string) {
+	srcSpec, srcRemote, err := ParseRemote(src)
+	if err != nil {
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
+
+	dstSpec, dstRemote, err := ParseRemote(dst)
+	if err != nil {
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case srcRemote && dstRemote:
+		fmt.Printf("✗ Remote to remote copy is not supported\n")
+		os.Exit(1)
+	case srcRemote:
+		Download(srcSpec.apply(opts), dst, srcSpec.Path)
+	case dstRemote:
+		Upload(dstSpec.apply(opts), src, dstSpec.Path)
+	default:
+		fmt.Printf("✗ Neither %q nor %q is a remote path ([user@]host[:port]:path)\n", src, dst)
+		os.Exit(1)
+	}
+}
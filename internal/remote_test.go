@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRemote(t *testing.T) {
+	tests := []struct {
+		arg    string
+		want   RemoteSpec
+		remote bool
+		// part of the error, empty for none
+		wantErr string
+	}{
+		{arg: "host:/var/www", want: RemoteSpec{Host: "host", Path: "/var/www"}, remote: true},
+		{arg: "alice@host:file.txt", want: RemoteSpec{User: "alice", Host: "host", Path: "file.txt"}, remote: true},
+		{arg: "alice@host:2222:/srv", want: RemoteSpec{User: "alice", Host: "host", Port: 2222, Path: "/srv"}, remote: true},
+		{arg: "host:", want: RemoteSpec{Host: "host", Path: "."}, remote: true},
+		{arg: "host:2222:", want: RemoteSpec{Host: "host", Port: 2222, Path: "."}, remote: true},
+		{arg: "[::1]:/tmp", want: RemoteSpec{Host: "::1", Path: "/tmp"}, remote: true},
+		{arg: "bob@[2001:db8::1]:22:/srv/data", want: RemoteSpec{User: "bob", Host: "2001:db8::1", Port: 22, Path: "/srv/data"}, remote: true},
+		{arg: "[fe80::1%eth0]:notes", want: RemoteSpec{Host: "fe80::1%eth0", Path: "notes"}, remote: true},
+		{arg: "[::1]:", want: RemoteSpec{Host: "::1", Path: "."}, remote: true},
+
+		{arg: "./local/file"},
+		{arg: "file.txt"},
+		{arg: "./dir:with:colons"},
+		{arg: "/abs/a:b"},
+		{arg: ":path"},
+		{arg: "@notes.txt"},
+
+		{arg: "[::1:/tmp", wantErr: "missing ']'"},
+		{arg: "[::1]/tmp", wantErr: "missing ':' after host"},
+		{arg: "[]:/tmp", wantErr: "empty host"},
+		{arg: "@host:/p", wantErr: "empty user"},
+		{arg: "@[::1]:/p", wantErr: "empty user"},
+		{arg: "host:70000:/p", wantErr: "invalid port 70000"},
+		{arg: "host:0:/p", wantErr: "invalid port 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			got, remote, err := ParseRemote(tt.arg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote != tt.remote {
+				t.Fatalf("remote %v, want %v", remote, tt.remote)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
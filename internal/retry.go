@@ -75,6 +75,8 @@ func isRetryAble(err error) bool {
 		"i/o timeout",
 		"network is unreachable",
 		"no route to host",
+		"connection lost",
+		"use of closed network connection",
 	}
 
 	for _, re := range retryAbleErrors {
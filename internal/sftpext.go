@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sftpInit          = 1
+	sftpVersion       = 2
+	sftpStatus        = 101
+	sftpExtended      = 200
+	sftpExtendedReply = 201
+
+	sftpProtocolVersion = 3
+	sftpMaxPacket       = 256 * 1024
+)
+
+// extClient is a minimal SFTP client on a channel of its own, used only
+// for the extended requests pkg/sftp cannot send (check-file, md5-hash,
+// limits@openssh.com). Requests are sent one at a time.
+type extClient struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+
+	mu         sync.Mutex
+	id         uint32
+	extensions map[string]string
+}
+
+func openExtClient(sshClient *ssh.Client) (*extClient, error) {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	c := &extClient{session: session, w: w, r: r, extensions: make(map[string]string)}
+	if err := c.init(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("sftp init failed: %w", err)
+	}
+	return c, nil
+}
+
+func (c *extClient) init() error {
+	if err := c.send(sftpInit, binary.BigEndian.AppendUint32(nil, sftpProtocolVersion)); err != nil {
+		return err
+	}
+
+	typ, data, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if typ != sftpVersion || len(data) < 4 {
+		return fmt.Errorf("unexpected packet type %d", typ)
+	}
+
+	data = data[4:]
+	for len(data) > 0 {
+		var name, value string
+		if name, data, err = readString(data); err != nil {
+			return err
+		}
+		if value, data, err = readString(data); err != nil {
+			return err
+		}
+		c.extensions[name] = value
+	}
+	return nil
+}
+
+func (c *extClient) Close() error {
+	return c.session.Close()
+}
+
+func (c *extClient) HasExtension(name string) (string, bool) {
+	value, ok := c.extensions[name]
+	return value, ok
+}
+
+// extended sends an SSH_FXP_EXTENDED request and returns the payload of
+// the SSH_FXP_EXTENDED_REPLY. A status reply is returned as an error.
+func (c *extClient) extended(request string, payload []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id++
+	data := binary.BigEndian.AppendUint32(nil, c.id)
+	data = appendString(data, request)
+	data = append(data, payload...)
+	if err := c.send(sftpExtended, data); err != nil {
+		return nil, err
+	}
+
+	typ, reply, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 4 || binary.BigEndian.Uint32(reply) != c.id {
+		return nil, fmt.Errorf("%s: unexpected reply", request)
+	}
+	reply = reply[4:]
+
+	switch typ {
+	case sftpExtendedReply:
+		return reply, nil
+	case sftpStatus:
+		if len(reply) < 4 {
+			return nil, fmt.Errorf("%s: malformed status", request)
+		}
+		msg, _, _ := readString(reply[4:])
+		return nil, fmt.Errorf("%s: server status %d: %s", request, binary.BigEndian.Uint32(reply), msg)
+	default:
+		return nil, fmt.Errorf("%s: unexpected packet type %d", request, typ)
+	}
+}
+
+func (c *extClient) send(typ byte, data []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(data)+1))
+	packet = append(packet, typ)
+	packet = append(packet, data...)
+	_, err := c.w.Write(packet)
+	return err
+}
+
+func (c *extClient) recv() (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(c.r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+var errShortPacket = errors.New("sftp packet too short")
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errShortPacket
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil, errShortPacket
+	}
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
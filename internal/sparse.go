@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+)
+
+// isZero reports whether b holds only zero bytes. Comparing b with itself
+// shifted by one lets bytes.Equal do the work at memcmp speed.
+func isZero(b []byte) bool {
+	return len(b) == 0 || b[0] == 0 && bytes.Equal(b[1:], b[:len(b)-1])
+}
+
+// holesFrom returns the size of the .part file at partPath. A sparse
+// transfer only leaves holes past it: after a resume, the part file may
+// still hold data of a changed source where zeros are due now.
+func holesFrom(stat func(string) (os.FileInfo, error), partPath string) int64 {
+	fi, err := stat(partPath)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return fi.Size()
+}
+
+// sparseReader reads the range r of f, returning the holes of f as
+// zeros without reading them from disk.
+func sparseReader(f *os.File, r byteRange) io.Reader {
+	extents, ok := dataExtents(f, r.Start, r.End)
+	if !ok {
+		return io.NewSectionReader(f, r.Start, r.Len())
+	}
+	return &holeReader{f: f, data: extents, off: r.Start, end: r.End}
+}
+
+type holeReader struct {
+	f io.ReaderAt
+	// the ranges holding data, in order
+	data []byteRange
+	off  int64
+	end  int64
+}
+
+// Read stops at every boundary between data and a hole, so that Chunker
+// sees holes as chunks of their own.
+func (h *holeReader) Read(p []byte) (int, error) {
+	if h.off >= h.end {
+		return 0, io.EOF
+	}
+	for len(h.data) > 0 && h.data[0].End <= h.off {
+		h.data = h.data[1:]
+	}
+
+	if len(h.data) > 0 && h.data[0].Start <= h.off {
+		want := min(int64(len(p)), h.data[0].End-h.off)
+		n, err := h.f.ReadAt(p[:want], h.off)
+		h.off += int64(n)
+		if err == io.EOF && int64(n) == want {
+			err = nil
+		}
+		return n, err
+	}
+
+	next := h.end
+	if len(h.data) > 0 {
+		next = h.data[0].Start
+	}
+	n := min(int64(len(p)), next-h.off)
+	clear(p[:n])
+	h.off += n
+	return int(n), nil
+}
+
+// zeroTail reads r, which holds size bytes, as if zeros followed up to
+// end: a sparse transfer gives its .part file the full size only once it
+// is complete, holes at the end are not there before.
+type zeroTail struct {
+	r    io.ReaderAt
+	size int64
+	end  int64
+}
+
+func (z zeroTail) ReadAt(p []byte, off int64) (int, error) {
+	if off >= z.end {
+		return 0, io.EOF
+	}
+
+	want := min(int64(len(p)), z.end-off)
+	n := 0
+	if off < z.size {
+		var err error
+		n, err = z.r.ReadAt(p[:min(want, z.size-off)], off)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	clear(p[n:want])
+
+	if want < int64(len(p)) {
+		return int(want), io.EOF
+	}
+	return int(want), nil
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataExtents returns the ranges of f between start and end that hold
+// data, using SEEK_DATA and SEEK_HOLE. It reports false when the file
+// system cannot tell.
+func dataExtents(f *os.File, start, end int64) ([]byteRange, bool) {
+	var extents []byteRange
+	for off := start; off < end; {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// nothing but a hole up to the end of the file
+			break
+		}
+		if err != nil {
+			return nil, false
+		}
+		if data >= end {
+			break
+		}
+
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, false
+		}
+		extents = append(extents, byteRange{data, min(hole, end)})
+		off = hole
+	}
+	return extents, true
+}
@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const systemSSHConfig = "/etc/ssh/ssh_config"
+
+// SSHConfig is a parsed ssh_config(5) file. Only the keywords goscp acts on
+// are interpreted, everything else is kept but ignored.
+type SSHConfig struct {
+	blocks []*configBlock
+}
+
+type configBlock struct {
+	hosts   []string
+	match   [][]string
+	options []configOption
+}
+
+type configOption struct {
+	key  string
+	args []string
+	raw  string
+}
+
+// HostConfig holds the values resolved for one destination host.
+type HostConfig struct {
+	HostName              string
+	User                  string
+	Port                  int
+	IdentityFiles         []string
+	CertificateFiles      []string
+	IdentitiesOnly        bool
+	UserKnownHostsFiles   []string
+	GlobalKnownHostsFiles []string
+	HashKnownHosts        bool
+	StrictHostKeyChecking string
+	ProxyJump             string
+	ProxyCommand          string
+	Ciphers               string
+	MACs                  string
+	KexAlgorithms         string
+	HostKeyAlgorithms     string
+}
+
+func DefaultSSHConfigPaths() []string {
+	home, _ := os.UserHomeDir()
+	return []string{
+		filepath.Join(home, ".ssh", "config"),
+		systemSSHConfig,
+	}
+}
+
+// LoadSSHConfig parses the files in order. Missing files are skipped, so
+// the result of an earlier file takes precedence as in OpenSSH.
+func LoadSSHConfig(paths ...string) (*SSHConfig, error) {
+	cfg := &SSHConfig{}
+	for _, path := range paths {
+		if err := cfg.parseFile(path, nil, 0); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func (c *SSHConfig) parseFile(path string, current *configBlock, depth int) error {
+	if depth > 16 {
+		return fmt.Errorf("%s: too many nested includes", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if current == nil {
+		// options before the first Host line apply to every host
+		current = &configBlock{hosts: []string{"*"}}
+		c.blocks = append(c.blocks, current)
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		key, args, raw, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			current = &configBlock{hosts: args}
+			c.blocks = append(c.blocks, current)
+		case "match":
+			criteria, err := parseMatch(args)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+			current = &configBlock{match: criteria}
+			c.blocks = append(c.blocks, current)
+		case "include":
+			parent, opened := current, len(c.blocks)
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(includeBase(path), pattern)
+				}
+
+				matches, _ := filepath.Glob(pattern)
+				for _, m := range matches {
+					if err := c.parseFile(m, current, depth+1); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+			// blocks opened by the included file end there, the rest of
+			// this one continues in a block of its own after them
+			if len(c.blocks) > opened {
+				current = &configBlock{hosts: parent.hosts, match: parent.match}
+				c.blocks = append(c.blocks, current)
+			}
+		default:
+			current.options = append(current.options, configOption{key: key, args: args, raw: raw})
+		}
+	}
+
+	return scanner.Err()
+}
+
+func includeBase(path string) string {
+	if filepath.Clean(path) == systemSSHConfig {
+		return filepath.Dir(systemSSHConfig)
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh")
+}
+
+// splitConfigLine returns the lower-cased keyword, its arguments and the
+// unsplit remainder of the line (used for commands such as ProxyCommand).
+// Keyword and arguments may be separated by whitespace or '='.
+func splitConfigLine(line string) (string, []string, string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, "", nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, "", nil
+	}
+
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	var (
+		args    []string
+		buf     strings.Builder
+		quoted  bool
+		pending bool
+	)
+	for i, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			pending = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if pending {
+				args = append(args, buf.String())
+				buf.Reset()
+				pending = false
+			}
+		case !quoted && r == '#' && !pending:
+			return key, args, strings.TrimSpace(rest[:i]), nil
+		default:
+			buf.WriteRune(r)
+			pending = true
+		}
+	}
+	if quoted {
+		return "", nil, "", fmt.Errorf("unterminated quote")
+	}
+	if pending {
+		args = append(args, buf.String())
+	}
+
+	return key, args, rest, nil
+}
+
+func parseMatch(args []string) ([][]string, error) {
+	var criteria [][]string
+	for i := 0; i < len(args); i++ {
+		name := strings.ToLower(args[i])
+		switch strings.TrimPrefix(name, "!") {
+		case "all", "canonical", "final":
+			criteria = append(criteria, []string{name})
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("match %s requires an argument", name)
+			}
+			criteria = append(criteria, []string{name, args[i+1]})
+			i++
+		default:
+			return nil, fmt.Errorf("unsupported match criteria %q", args[i])
+		}
+	}
+	return criteria, nil
+}
+
+func (b *configBlock) matches(original string, hc *HostConfig, remoteUser string) bool {
+	if b.hosts != nil {
+		return matchPatternList(b.hosts, original)
+	}
+
+	host := original
+	if hc.HostName != "" {
+		host = hc.HostName
+	}
+	if hc.User != "" {
+		remoteUser = hc.User
+	}
+
+	for _, criterion := range b.match {
+		name := criterion[0]
+		negate := strings.HasPrefix(name, "!")
+		name = strings.TrimPrefix(name, "!")
+
+		var ok bool
+		switch name {
+		case "all", "final":
+			ok = true
+		case "canonical":
+			ok = false
+		case "host":
+			ok = matchPatternList(strings.Split(criterion[1], ","), host)
+		case "originalhost":
+			ok = matchPatternList(strings.Split(criterion[1], ","), original)
+		case "user":
+			ok = matchPatternList(strings.Split(criterion[1], ","), remoteUser)
+		case "localuser":
+			ok = matchPatternList(strings.Split(criterion[1], ","), localUsername())
+		case "exec":
+			// running arbitrary commands from config is not supported
+			ok = false
+		}
+
+		if ok == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve evaluates every matching block for host. As in OpenSSH the first
+// value obtained for a keyword wins, except IdentityFile and CertificateFile
+// which accumulate.
+func (c *SSHConfig) Resolve(host, remoteUser string) HostConfig {
+	hc := HostConfig{}
+	seen := make(map[string]bool)
+
+	for _, block := range c.blocks {
+		if !block.matches(host, &hc, remoteUser) {
+			continue
+		}
+
+		for _, opt := range block.options {
+			if len(opt.args) == 0 {
+				continue
+			}
+			switch opt.key {
+			case "identityfile":
+				hc.IdentityFiles = append(hc.IdentityFiles, opt.args[0])
+				continue
+			case "certificatefile":
+				hc.CertificateFiles = append(hc.CertificateFiles, opt.args[0])
+				continue
+			}
+			if seen[opt.key] {
+				continue
+			}
+			seen[opt.key] = true
+
+			switch opt.key {
+			case "hostname":
+				hc.HostName = opt.args[0]
+			case "user":
+				hc.User = opt.args[0]
+			case "port":
+				hc.Port, _ = strconv.Atoi(opt.args[0])
+			case "identitiesonly":
+				hc.IdentitiesOnly = strings.EqualFold(opt.args[0], "yes")
+			case "userknownhostsfile":
+				hc.UserKnownHostsFiles = opt.args
+			case "globalknownhostsfile":
+				hc.GlobalKnownHostsFiles = opt.args
+			case "hashknownhosts":
+				hc.HashKnownHosts = strings.EqualFold(opt.args[0], "yes")
+			case "stricthostkeychecking":
+				hc.StrictHostKeyChecking = strings.ToLower(opt.args[0])
+			case "proxyjump":
+				hc.ProxyJump = opt.args[0]
+			case "proxycommand":
+				hc.ProxyCommand = opt.raw
+			case "ciphers":
+				hc.Ciphers = opt.args[0]
+			case "macs":
+				hc.MACs = opt.args[0]
+			case "kexalgorithms":
+				hc.KexAlgorithms = opt.args[0]
+			case "hostkeyalgorithms":
+				hc.HostKeyAlgorithms = opt.args[0]
+			default:
+				delete(seen, opt.key)
+			}
+		}
+	}
+
+	if hc.HostName == "" {
+		hc.HostName = host
+	} else {
+		hc.HostName = strings.ReplaceAll(hc.HostName, "%h", host)
+	}
+	return hc
+}
+
+// expandTokens replaces the ssh_config percent tokens goscp knows about.
+func expandTokens(s, host, remoteUser string, port int) string {
+	home, _ := os.UserHomeDir()
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%p", strconv.Itoa(port),
+		"%r", remoteUser,
+		"%u", localUsername(),
+		"%d", home,
+	)
+	return expandHome(r.Replace(s))
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, path[1:])
+	}
+	return path
+}
+
+func localUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// matchPatternList reports whether s matches the comma or space separated
+// patterns. A matching negated pattern ("!pattern") always wins.
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchPattern(p[1:], s) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(p, s) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern implements the OpenSSH wildcard syntax, where '*' matches
+// any run of characters and '?' exactly one. Matching is case-insensitive.
+func matchPattern(pattern, s string) bool {
+	pattern = strings.ToLower(pattern)
+	s = strings.ToLower(s)
+
+	px, sx := 0, 0
+	starPx, starSx := -1, 0
+	for sx < len(s) {
+		switch {
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == s[sx]):
+			px++
+			sx++
+		case px < len(pattern) && pattern[px] == '*':
+			starPx, starSx = px, sx
+			px++
+		case starPx >= 0:
+			px = starPx + 1
+			starSx++
+			sx = starSx
+		default:
+			return false
+		}
+	}
+
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
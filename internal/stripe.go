@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const (
+	// files are split into ranges of this size, handed out to the stripes
+	stripeRangeSize = 16 * 1024 * 1024
+)
+
+// transferPool connects for a transfer; every stripe gets a connection of
+// its own.
+func transferPool(ep *Endpoint, opts Options) (*Pool, error) {
+	return NewPool(ep, max(opts.Connections, opts.Stripes), opts.Sessions)
+}
+
+// stripeFunc copies one range using a leased session.
+type stripeFunc func(client *Client, r byteRange, progress func(int)) error
+
+// runStripes hands the missing ranges of the journal to up to stripes
+// workers, each with its own session from the pool.
+func runStripes(pool *Pool, j *journal, stripes int, bar *progressbar.ProgressBar, copyRange stripeFunc) error {
+	ranges := j.missing(stripeRangeSize)
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	queue := make(chan byteRange, len(ranges))
+	for _, r := range ranges {
+		queue <- r
+	}
+	close(queue)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		ferr error
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return ferr != nil
+	}
+
+	for i := 0; i < min(stripes, len(ranges)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := pool.Do(func(client *Client) error {
+				for r := range queue {
+					if failed() {
+						return nil
+					}
+					if err := copyRange(client, r, func(n int) { bar.Add(n) }); err != nil {
+						return fmt.Errorf("range %d-%d: %w", r.Start, r.End, err)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				mu.Lock()
+				if ferr == nil {
+					ferr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return ferr
+}
+
+// uploadFileStriped uploads one file as parallel byte ranges, each over its
+// own session, into the .part file and renames it once all ranges are in.
+// The ranges are read out of order: the file is verified block by block
+// against check-file, or hashed again when the server cannot do that.
+func uploadFileStriped(pool *Pool, opts Options, localPath, remotePath string) error {
+	partPath := remotePath + ".part"
+
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("cannot open local file: %w", err)
+	}
+	defer localFile.Close()
+
+	fileInfo, err := localFile.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat local file: %w", err)
+	}
+
+	var (
+		j     *journal
+		check *checksum
+	)
+	err = pool.Do(func(client *Client) error {
+		if check, err = selectChecksum(client, opts); err != nil {
+			return err
+		}
+		j, err = resumeUpload(client, localFile, fileInfo, partPath, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var sparseFrom int64
+	if opts.Sparse {
+		err = pool.Do(func(client *Client) error {
+			sparseFrom = holesFrom(client.SFTP().Stat, partPath)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	bar := progressBar(fileInfo, localPath)
+	bar.Add64(j.completed())
+
+	err = runStripes(pool, j, opts.Stripes, bar, func(client *Client, r byteRange, progress func(int)) error {
+		store := sftpStore{client.SFTP()}
+		t := NewTransfer(client)
+		t.journal, t.store = j, store
+		t.sparse, t.holesFrom = opts.Sparse, sparseFrom
+
+		if err := t.UploadFile(localPath, partPath, r, progress); err != nil {
+			j.checkpoint(store, true)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return pool.Do(func(client *Client) error {
+		return finishPart(client, opts, completePart{
+			upload:     true,
+			localPath:  localPath,
+			remotePath: remotePath,
+			journal:    j,
+			check:      check,
+			preserve: func() error {
+				return preserveRemote(client, opts, fileInfo, remotePath)
+			},
+		})
+	})
+}
+
+// downloadFileStriped is the download counterpart of uploadFileStriped.
+func downloadFileStriped(pool *Pool, opts Options, remotePath, localPath string) error {
+	partPath := localPath + ".part"
+
+	var (
+		remoteInfo os.FileInfo
+		check      *checksum
+	)
+	err := pool.Do(func(client *Client) error {
+		var err error
+		if remoteInfo, err = client.SFTP().Stat(remotePath); err != nil {
+			return fmt.Errorf("cannot stat remote file : %w", err)
+		}
+		check, err = selectChecksum(client, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	store := localStore{}
+	j, err := resumeDownload(remoteInfo, partPath, opts.Sparse)
+	if err != nil {
+		return err
+	}
+
+	var sparseFrom int64
+	if opts.Sparse {
+		sparseFrom = holesFrom(os.Stat, partPath)
+	}
+
+	bar := progressBar(remoteInfo, remotePath)
+	bar.Add64(j.completed())
+
+	err = runStripes(pool, j, opts.Stripes, bar, func(client *Client, r byteRange, progress func(int)) error {
+		t := NewTransfer(client)
+		t.journal, t.store = j, store
+		t.sparse, t.holesFrom = opts.Sparse, sparseFrom
+
+		if err := t.DownloadFile(partPath, remotePath, r, progress); err != nil {
+			j.checkpoint(store, true)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return pool.Do(func(client *Client) error {
+		return finishPart(client, opts, completePart{
+			localPath:  localPath,
+			remotePath: remotePath,
+			journal:    j,
+			check:      check,
+			preserve: func() error {
+				return preserveLocal(client, opts, remoteInfo, localPath)
+			},
+		})
+	})
+}
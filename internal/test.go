@@ -3,26 +3,45 @@ package internal
 import (
 	"fmt"
 	"os"
-
-	"golang.org/x/crypto/ssh"
 )
 
-func testConn(serverAddr string, sshCfg *ssh.ClientConfig) error {
-	sshClient, err := NewClient(serverAddr, sshCfg)
+func Test(opts Options, showAlgorithms bool) {
+	ep := Initiate(opts)
+	defer ep.Close()
+
+	client, err := ep.Connect()
 	if err != nil {
-		return fmt.Errorf("ssh dial failed: %w", err)
+		fmt.Printf("✗ Connection failed: %v\n", err)
+		os.Exit(1)
 	}
-	defer sshClient.Close()
-	return nil
-}
+	defer client.Close()
 
-func Test(user, host, keyPath string, port int) {
-	serverAddr, sshCfg := Initiate(user, host, keyPath, port)
+	fmt.Printf("✓ Connection successful to %s\n", ep.Addr)
+	for _, hop := range ep.Jump {
+		fmt.Printf("  Via jump host: %s (%s)\n", hop.Addr, hop.AuthMethod())
+	}
+	fmt.Printf("  Authenticated with: %s\n", ep.AuthMethod())
+	for _, cert := range ep.Certificates {
+		fmt.Printf("  Certificate: %s\n", DescribeCertificate(cert))
+	}
 
-	if err := testConn(serverAddr, sshCfg); err != nil {
-		fmt.Printf("✗ Connection failed: %v\n", err)
-		os.Exit(1)
+	if showAlgorithms {
+		algos, ok := client.NegotiatedAlgorithms()
+		if !ok {
+			fmt.Fprintf(os.Stderr, "⚠ negotiated algorithms not available\n")
+			return
+		}
+		fmt.Printf("  Key exchange: %s\n", algos.KeyExchange)
+		fmt.Printf("  Host key: %s\n", algos.HostKey)
+		fmt.Printf("  Cipher: %s (out) / %s (in)\n", algos.Write.Cipher, algos.Read.Cipher)
+		fmt.Printf("  MAC: %s (out) / %s (in)\n", macName(algos.Write.Cipher, algos.Write.MAC), macName(algos.Read.Cipher, algos.Read.MAC))
 	}
+}
 
-	fmt.Printf("✓ Connection successful to %s\n", serverAddr)
+// macName reports the MAC in use; AEAD ciphers carry their own.
+func macName(cipher, mac string) string {
+	if mac == "" {
+		return "implicit (" + cipher + ")"
+	}
+	return mac
 }
@@ -1,13 +1,10 @@
 package internal
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
@@ -17,25 +14,98 @@ import (
 
 const (
 	MAX_FILE_SIZE = 100 * 1024 * 1024
-	PACKET_SIZE   = 32 * 1024
 )
 
 type transfer struct {
-	client     *sftp.Client
-	workers    int
-	bufferSize int
+	conn   *Client
+	client *sftp.Client
+
+	// workers and buffer size, set up by UploadFile and DownloadFile
+	tuner *tuner
+
+	// resume journal updated by Chunker, optional
+	journal *journal
+	store   journalStore
+
+	// checksum of the file computed by Chunker, optional
+	hash *inlineHash
+
+	// with --sparse, all-zero chunks at or past holesFrom are not written
+	sparse    bool
+	holesFrom int64
 }
 
-func NewTransfer(c *sftp.Client) transfer {
+// completePart is a .part file holding every block of a transfer.
+type completePart struct {
+	upload     bool
+	localPath  string
+	remotePath string
+	journal    *journal
+	check      *checksum
+	// hash taken while the data streamed, empty to hash the file again
+	localSum string
+	// applies the source attributes once the file is in place
+	preserve func() error
+}
+
+// finishPart puts the .part file in place of the destination, drops the
+// journal, verifies the result and preserves the source attributes.
+func finishPart(client *Client, opts Options, p completePart) error {
+	var store partStore = localStore{}
+	dst := p.localPath
+	if p.upload {
+		store, dst = sftpStore{client.SFTP()}, p.remotePath
+	}
+
+	partPath := dst + ".part"
+	if opts.Sparse {
+		// a hole at the end was never written
+		if err := store.truncate(partPath, p.journal.size); err != nil {
+			return fmt.Errorf("cannot set size of part file: %w", err)
+		}
+	}
+
+	if err := store.replace(partPath, dst); err != nil {
+		return fmt.Errorf("failed to rename part file: %w", err)
+	}
+	p.journal.remove(store)
+
+	verified := false
+	if p.localSum == "" {
+		// striped ranges were hashed per block, not in file order
+		var err error
+		if verified, err = verifyJournal(client, p.check, p.journal, p.remotePath); err != nil {
+			return err
+		}
+	}
+	if !verified {
+		if err := verifyIntegrity(client, p.check, p.localPath, p.remotePath, p.localSum); err != nil {
+			return err
+		}
+	}
+	return p.preserve()
+}
+
+func NewTransfer(c *Client) transfer {
 	return transfer{
-		client:     c,
-		workers:    autoWorker(),
-		bufferSize: PACKET_SIZE,
+		conn:   c,
+		client: c.SFTP(),
 	}
 }
 
-func autoWorker() int {
-	return 8
+// tune sets up the tuner for the first range transferred, size bytes long.
+func (t *transfer) tune(size int64, remoteRead bool) {
+	if t.tuner == nil {
+		t.tuner = newTuner(t.conn, size, remoteRead)
+	}
+}
+
+// sum returns the checksum of the file, empty without one.
+func (t *transfer) sum() (string, error) {
+	if t.hash == nil {
+		return "", nil
+	}
+	return t.hash.sum()
 }
 
 func (t *transfer) Chunker(reader io.Reader, writer io.WriterAt, offset int64, progress func(int)) error {
@@ -45,15 +115,29 @@ func (t *transfer) Chunker(reader io.Reader, writer io.WriterAt, offset int64, p
 		offset int64
 	}
 
-	ch := make(chan chunk, t.workers)
+	if t.journal != nil {
+		reader, writer = t.journal.track(reader, writer, offset, t.store)
+	}
+	if t.hash != nil {
+		reader = t.hash.tee(reader, offset)
+	}
+	if t.tuner == nil {
+		t.tuner = &tuner{workers: tuneWorkers, buffer: defaultPacketSize, done: true}
+	}
+
+	ch := make(chan chunk)
 	wg := sync.WaitGroup{}
 	errChan := make(chan error, 1)
 
-	for i := 0; i < t.workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for c := range ch {
+	worker := func() {
+		defer wg.Done()
+		for c := range ch {
+			if t.sparse && c.offset >= t.holesFrom && isZero(c.data[:c.n]) {
+				// left as a hole, the file gets its size from a final Truncate
+				if t.journal != nil {
+					t.journal.record(t.store, c.offset, int64(c.n))
+				}
+			} else {
 				_, err := writer.WriteAt(c.data[:c.n], c.offset)
 				if err != nil {
 					select {
@@ -62,18 +146,20 @@ func (t *transfer) Chunker(reader io.Reader, writer io.WriterAt, offset int64, p
 					}
 					return
 				}
+				t.tuner.add(c.n)
+			}
 
-				if progress != nil {
-					progress(c.n)
-				}
+			if progress != nil {
+				progress(c.n)
 			}
-		}()
+		}
 	}
 
 	defer wg.Wait()
 	defer close(ch)
 
-	buf := make([]byte, t.bufferSize)
+	var buf []byte
+	running := 0
 	currentOffset := offset
 
 	for {
@@ -83,6 +169,16 @@ func (t *transfer) Chunker(reader io.Reader, writer io.WriterAt, offset int64, p
 		default:
 		}
 
+		// the tuner may have asked for more workers or a larger buffer
+		workers, bufferSize := t.tuner.knobs()
+		for ; running < workers; running++ {
+			wg.Add(1)
+			go worker()
+		}
+		if len(buf) != bufferSize {
+			buf = make([]byte, bufferSize)
+		}
+
 		n, err := reader.Read(buf)
 		if n > 0 {
 			tmp := make([]byte, n)
@@ -118,43 +214,6 @@ func (t *transfer) Chunker(reader io.Reader, writer io.WriterAt, offset int64, p
 	return nil
 }
 
-func verifyIntegrity(client *Client, localPath, remotePath string) error {
-	f, err := os.Open(localPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return err
-	}
-	localSum := hex.EncodeToString(h.Sum(nil))
-
-	session, err := client.NewSession()
-	if err != nil {
-		return fmt.Errorf("failed to create ssh session for verification: %w", err)
-	}
-	defer session.Close()
-
-	output, err := session.CombinedOutput(fmt.Sprintf("md5sum '%s'", remotePath))
-	if err != nil {
-		return fmt.Errorf("remote md5sum command failed: %w, output: %s", err, string(output))
-	}
-
-	fields := strings.Fields(string(output))
-	if len(fields) < 1 {
-		return fmt.Errorf("unexpected output from md5sum: %s", string(output))
-	}
-	remoteSum := fields[0]
-
-	if localSum != remoteSum {
-		return fmt.Errorf("checksum mismatch: local=%s, remote=%s", localSum, remoteSum)
-	}
-
-	return nil
-}
-
 func progressBar(file os.FileInfo, path string) *progressbar.ProgressBar {
 	return progressbar.NewOptions64(
 		file.Size(),
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// every server accepts 32 KiB reads and writes
+	defaultPacketSize = 32 * 1024
+	// room for the header of a read or write request: lengths, type,
+	// request id, handle and offset
+	packetOverhead = 1024
+	// pkg/sftp refuses messages over 256 KiB, headers included
+	maxPacketSize   = 256*1024 - packetOverhead
+	defaultRequests = 64
+
+	tuneWorkers = 8
+	// x/crypto/ssh opens channels with a 2 MiB window, more in flight on a
+	// single session only fills memory; use more connections instead
+	tuneMaxInflight = 4 * 1024 * 1024
+	tuneMaxBuffer   = 1024 * 1024
+	tuneMaxWorkers  = 32
+	// files too small to learn anything from keep the initial values
+	tuneMinSize  = 4 * 1024 * 1024
+	tuneInterval = 250 * time.Millisecond
+	tunePeriod   = 3 * time.Second
+)
+
+// Tuning overrides the transfer knobs. Zero values are chosen
+// automatically: packet size from the server limits, workers and buffer
+// size adapted while the first seconds of each file are sent.
+type Tuning struct {
+	// concurrent writes of one file
+	Workers int
+	// bytes read at once from the source
+	BufferSize int
+	// bytes per SFTP read or write request
+	PacketSize int
+	// SFTP requests in flight for one read or write call
+	Requests int
+}
+
+func (t Tuning) validate() error {
+	if t.Workers < 0 || t.BufferSize < 0 || t.PacketSize < 0 || t.Requests < 0 {
+		return fmt.Errorf("--workers, --buffer-size, --packet-size and --requests cannot be negative")
+	}
+	if t.PacketSize > maxPacketSize {
+		return fmt.Errorf("--packet-size cannot exceed %d", maxPacketSize)
+	}
+	return nil
+}
+
+func (t Tuning) requests() int {
+	if t.Requests > 0 {
+		return t.Requests
+	}
+	return defaultRequests
+}
+
+// packetSize returns the override, or the smallest limit the server
+// announces in limits@openssh.com, or 32 KiB.
+func (t Tuning) packetSize(client *Client) int {
+	if t.PacketSize > 0 {
+		return t.PacketSize
+	}
+	return serverPacketSize(client)
+}
+
+func serverPacketSize(client *Client) int {
+	conn := client.conn
+	conn.mu.Lock()
+	size := conn.packetSize
+	conn.mu.Unlock()
+	if size > 0 {
+		return size
+	}
+
+	size = defaultPacketSize
+	if limit := probePacketLimit(client.Client); limit > 0 {
+		size = limit
+	}
+
+	conn.mu.Lock()
+	conn.packetSize = size
+	conn.mu.Unlock()
+	return size
+}
+
+// probePacketLimit asks limits@openssh.com on a channel of its own, closed
+// before the SFTP session is opened so that servers allowing a single
+// session still accept it. It returns 0 when the probe cannot run.
+func probePacketLimit(sshClient *ssh.Client) int {
+	ext, err := openExtClient(sshClient)
+	if err != nil {
+		return 0
+	}
+	defer func() {
+		ext.Close()
+		// the server counts the channel until it confirms the close
+		ext.session.Wait()
+	}()
+
+	if _, ok := ext.HasExtension("limits@openssh.com"); !ok {
+		return 0
+	}
+	reply, err := ext.extended("limits@openssh.com", nil)
+	if err != nil {
+		return 0
+	}
+	return packetLimit(reply)
+}
+
+// packetLimit returns the largest read or write the limits@openssh.com
+// reply allows, or 0 when it cannot be parsed. The reply holds the max
+// packet length, max read length, max write length and max open handles;
+// zero means no limit.
+func packetLimit(reply []byte) int {
+	if len(reply) < 24 {
+		return 0
+	}
+
+	limit := uint64(maxPacketSize)
+	// a write request carries its header in the same packet
+	if l := binary.BigEndian.Uint64(reply[0:]); l > 0 {
+		limit = min(limit, l-min(l/2, packetOverhead))
+	}
+	for _, l := range []uint64{binary.BigEndian.Uint64(reply[8:]), binary.BigEndian.Uint64(reply[16:])} {
+		if l > 0 {
+			limit = min(limit, l)
+		}
+	}
+	return int(limit)
+}
+
+// connRTT measures the round trip time of the connection once, as the
+// best of a few keepalives. It returns zero when they fail.
+func connRTT(client *Client) time.Duration {
+	conn := client.conn
+	conn.mu.Lock()
+	rtt := conn.rtt
+	conn.mu.Unlock()
+	if rtt > 0 {
+		return rtt
+	}
+
+	var best time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if err := ping(client); err != nil {
+			return 0
+		}
+		if d := time.Since(start); best == 0 || d < best {
+			best = d
+		}
+	}
+
+	conn.mu.Lock()
+	conn.rtt = best
+	conn.mu.Unlock()
+	return best
+}
+
+// tuner adapts the data Chunker keeps in flight. While the throughput
+// times the round trip time is close to what is in flight, the link is
+// latency bound and more in flight helps: the buffer grows first, then
+// the number of workers. It stops once the link is bandwidth bound, more
+// made things slower, or the first seconds are over.
+type tuner struct {
+	rtt time.Duration
+	// downloads read the remote file from a single reader, only the
+	// buffer size puts more in flight
+	remoteRead   bool
+	fixedWorkers bool
+	fixedBuffer  bool
+	maxBuffer    int
+
+	mu         sync.Mutex
+	workers    int
+	buffer     int
+	prevBuffer int
+	start      time.Time
+	last       time.Time
+	bytes      int64
+	lastBytes  int64
+	best       float64
+	done       bool
+}
+
+func newTuner(client *Client, size int64, remoteRead bool) *tuner {
+	t := client.tuning
+	packet := t.packetSize(client)
+
+	tu := &tuner{
+		remoteRead:   remoteRead,
+		fixedWorkers: t.Workers > 0,
+		fixedBuffer:  t.BufferSize > 0,
+		maxBuffer:    min(tuneMaxBuffer, packet*t.requests()),
+		workers:      t.Workers,
+		buffer:       t.BufferSize,
+	}
+	if !tu.fixedWorkers {
+		tu.workers = tuneWorkers
+	}
+	if !tu.fixedBuffer {
+		// a few packets per call, less for small files so that they are
+		// still written by several workers
+		tu.buffer = int(min(max(size/int64(tu.workers), int64(packet)), int64(4*packet)))
+	}
+
+	tu.done = (tu.fixedWorkers && tu.fixedBuffer) || size < tuneMinSize
+	if !tu.done {
+		tu.rtt = connRTT(client)
+		tu.done = tu.rtt <= 0
+	}
+	tu.start = time.Now()
+	tu.last = tu.start
+	return tu
+}
+
+func (tu *tuner) knobs() (workers, buffer int) {
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+	return tu.workers, tu.buffer
+}
+
+// add records n bytes written and adjusts the knobs every tuneInterval.
+func (tu *tuner) add(n int) {
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+
+	tu.bytes += int64(n)
+	now := time.Now()
+	if tu.done || now.Sub(tu.last) < tuneInterval {
+		return
+	}
+
+	rate := float64(tu.bytes-tu.lastBytes) / now.Sub(tu.last).Seconds()
+	tu.last, tu.lastBytes = now, tu.bytes
+	if now.Sub(tu.start) > tunePeriod {
+		tu.done = true
+		return
+	}
+	if tu.best == 0 {
+		// the first interval includes the TCP slow start
+		tu.best = rate
+		return
+	}
+	if tu.prevBuffer > 0 && rate < tu.best*0.9 {
+		// running workers cannot be stopped, only the buffer goes back
+		tu.buffer = tu.prevBuffer
+		tu.done = true
+		return
+	}
+	tu.best = max(tu.best, rate)
+
+	inflight := tu.buffer
+	if !tu.remoteRead {
+		inflight *= tu.workers
+	}
+	if rate*tu.rtt.Seconds() < float64(inflight)/2 || inflight >= tuneMaxInflight {
+		tu.done = true
+		return
+	}
+
+	tu.prevBuffer = tu.buffer
+	switch {
+	case !tu.fixedBuffer && tu.buffer < tu.maxBuffer:
+		tu.buffer = min(2*tu.buffer, tu.maxBuffer)
+	case !tu.fixedWorkers && !tu.remoteRead && tu.workers < tuneMaxWorkers:
+		tu.workers = min(2*tu.workers, tuneMaxWorkers)
+	default:
+		tu.done = true
+	}
+}
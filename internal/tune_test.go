@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestPacketLimit(t *testing.T) {
+	limits := func(packet, read, write uint64) []byte {
+		reply := make([]byte, 32)
+		binary.BigEndian.PutUint64(reply[0:], packet)
+		binary.BigEndian.PutUint64(reply[8:], read)
+		binary.BigEndian.PutUint64(reply[16:], write)
+		return reply
+	}
+
+	tests := []struct {
+		name  string
+		reply []byte
+		want  int
+	}{
+		{"openssh", limits(256*1024, 256*1024-1024, 256*1024-1024), 256*1024 - 1024},
+		{"no limits", limits(0, 0, 0), maxPacketSize},
+		{"small write limit", limits(0, 64*1024, 16*1024), 16 * 1024},
+		{"small read limit", limits(0, 8*1024, 0), 8 * 1024},
+		{"small packets", limits(16*1024, 0, 0), 16*1024 - packetOverhead},
+		{"packet smaller than reads", limits(20*1024, 32*1024, 32*1024), 20*1024 - packetOverhead},
+		{"above what pkg/sftp accepts", limits(1<<30, 1<<30, 1<<30), maxPacketSize},
+		{"tiny packets", limits(512, 0, 0), 256},
+		{"short reply", make([]byte, 16), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := packetLimit(tt.reply); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,89 +1,115 @@
 package internal
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 )
 
-func (u *transfer) UploadFile(localPath, remotePath string, offset int64, progress func(int)) error {
+// UploadFile copies the byte range r of localPath into remotePath, which
+// must already exist.
+func (u *transfer) UploadFile(localPath, remotePath string, r byteRange, progress func(int)) error {
 	local, err := os.Open(localPath)
 	if err != nil {
 		return err
 	}
 	defer local.Close()
 
-	if offset > 0 {
-		_, err = local.Seek(offset, io.SeekStart)
-		if err != nil {
-			return fmt.Errorf("failed to seek local file: %w", err)
-		}
+	remote, err := u.client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
 	}
+	defer remote.Close()
 
-	flags := os.O_RDWR | os.O_CREATE
-	if offset == 0 {
-		flags |= os.O_TRUNC
+	var reader io.Reader = io.NewSectionReader(local, r.Start, r.Len())
+	if u.sparse {
+		reader = sparseReader(local, r)
 	}
 
-	remote, err := u.client.OpenFile(remotePath, flags)
+	u.tune(r.Len(), false)
+	return u.Chunker(reader, remote, r.Start, progress)
+}
+
+func Upload(opts Options, localPath, remotePath string) {
+	opts, remotePath = remoteArg(opts, remotePath)
+	opts, err := parseTransferOptions(opts)
 	if err != nil {
-		return err
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
 	}
-	defer remote.Close()
 
-	return u.Chunker(local, remote, offset, progress)
-}
+	ep := Initiate(opts)
+	err = upload(ep, opts, localPath, remotePath)
+	// os.Exit does not run deferred calls
+	ep.Close()
+	if err != nil {
+		fmt.Printf("✗ %v\n", err)
+		os.Exit(1)
+	}
 
-func Upload(user, host string, port int, keypath, localPath, remotePath string, maxRetry int) {
-	serverAddr, sshCfg := Initiate(user, host, keypath, port)
-	retryCfg := DefaultRetry(maxRetry)
+	fmt.Printf("✓ Upload successful\n")
+}
 
-	err := WithRetry(retryCfg, func() error {
-		client, err := NewClient(serverAddr, sshCfg)
-		if err != nil {
-			fmt.Printf("✗ Connection failed: %v\n", err)
-			os.Exit(1)
-		}
-		defer client.Close()
+// upload connects and transfers localPath, closing every connection before
+// it returns.
+func upload(ep *Endpoint, opts Options, localPath, remotePath string) error {
+	pool, err := transferPool(ep, opts)
+	if err != nil {
+		return fmt.Errorf("Connection failed: %w", err)
+	}
+	defer pool.Close()
 
+	err = WithRetry(DefaultRetry(opts.Retry), func() error {
 		dataInfo, err := os.Stat(localPath)
 		if err != nil {
-			fmt.Printf("✗ Cannot access local path: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("cannot access local path: %w", err)
 		}
 
 		if dataInfo.IsDir() {
 			// directory handle
-			return uploadDir(client, localPath, remotePath)
+			return uploadDir(pool, opts, localPath, remotePath)
 		}
 
 		// file handle
-		remoteInfo, statErr := client.SFTP().Stat(remotePath)
-		isRemoteDir := statErr == nil && remoteInfo.IsDir()
-		if isRemoteDir || strings.HasSuffix(remotePath, "/") {
-			if !isRemoteDir {
-				if err := client.SFTP().MkdirAll(remotePath); err != nil {
-					return fmt.Errorf("cannot create remote directory: %w", err)
+		dst := remotePath
+		err = pool.Do(func(client *Client) error {
+			remoteInfo, statErr := client.SFTP().Stat(dst)
+			isRemoteDir := statErr == nil && remoteInfo.IsDir()
+			if isRemoteDir || strings.HasSuffix(dst, "/") {
+				if !isRemoteDir {
+					if err := client.SFTP().MkdirAll(dst); err != nil {
+						return fmt.Errorf("cannot create remote directory: %w", err)
+					}
 				}
+				dst = filepath.ToSlash(filepath.Join(dst, filepath.Base(localPath)))
 			}
-			remotePath = filepath.ToSlash(filepath.Join(remotePath, filepath.Base(localPath)))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if opts.Stripes > 1 && dataInfo.Size() > stripeRangeSize {
+			return uploadFileStriped(pool, opts, localPath, dst)
 		}
-		return uploadFile(client, localPath, remotePath)
+		return pool.Do(func(client *Client) error {
+			return uploadFile(client, opts, localPath, dst)
+		})
 	})
 
 	if err != nil {
-		fmt.Printf("✗ Upload failed: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("Upload failed: %w", err)
 	}
-
-	fmt.Printf("✓ Upload successful\n")
+	return nil
 }
 
-func uploadFile(client *Client, localPath, remotePath string) error {
+func uploadFile(client *Client, opts Options, localPath, remotePath string) error {
 	sftpClient := client.SFTP()
 	partPath := remotePath + ".part"
 
@@ -98,64 +124,204 @@ func uploadFile(client *Client, localPath, remotePath string) error {
 		return fmt.Errorf("cannot stat local file: %w", err)
 	}
 
-	var offset int64 = 0
-	remoteFileInfo, err := sftpClient.Stat(partPath)
-	if err == nil {
-		// .part file exists
-		if remoteFileInfo.Size() < fileInfo.Size() {
-			offset = remoteFileInfo.Size()
-			fmt.Printf("Resuming upload from %d bytes (%.2f%%)\n", offset, float64(offset)/float64(fileInfo.Size())*100)
-		}
+	check, err := selectChecksum(client, opts)
+	if err != nil {
+		return err
+	}
+
+	store := sftpStore{sftpClient}
+	j, err := resumeUpload(client, localFile, fileInfo, partPath, opts)
+	if err != nil {
+		return err
 	}
 
 	bar := progressBar(fileInfo, localPath)
-	if offset > 0 {
-		bar.Add64(offset)
+	bar.Add64(j.completed())
+
+	uploader := NewTransfer(client)
+	uploader.journal, uploader.store = j, store
+	if opts.Sparse {
+		uploader.sparse, uploader.holesFrom = true, holesFrom(sftpClient.Stat, partPath)
+	}
+	if check != nil {
+		uploader.hash = newInlineHash(check.algo, localFile, fileInfo.Size())
+	}
+	for _, r := range j.missing(0) {
+		err = uploader.UploadFile(localPath, partPath, r, func(n int) {
+			bar.Add(n)
+		})
+		if err != nil {
+			j.checkpoint(store, true)
+			return err
+		}
 	}
 
-	uploader := NewTransfer(sftpClient)
-	err = uploader.UploadFile(localPath, partPath, offset, func(n int) {
-		bar.Add(n)
+	localSum, err := uploader.sum()
+	if err != nil {
+		return fmt.Errorf("cannot hash local file: %w", err)
+	}
+	return finishPart(client, opts, completePart{
+		upload:     true,
+		localPath:  localPath,
+		remotePath: remotePath,
+		journal:    j,
+		check:      check,
+		localSum:   localSum,
+		preserve: func() error {
+			return preserveRemote(client, opts, fileInfo, remotePath)
+		},
 	})
+}
+
+// resumeUpload loads the journal of an interrupted upload and checks it
+// against the local source and the remote .part file, or creates an empty
+// .part file when there is nothing to resume.
+func resumeUpload(client *Client, localFile *os.File, fileInfo os.FileInfo, partPath string, opts Options) (*journal, error) {
+	sftpClient := client.SFTP()
+	j := loadJournal(sftpStore{sftpClient}, partPath, fileInfo)
+
+	if j.completed() > 0 {
+		if dropped, err := j.verify(localFile); err != nil {
+			return nil, fmt.Errorf("cannot verify local file: %w", err)
+		} else if dropped > 0 {
+			fmt.Fprintf(os.Stderr, "⚠ %d blocks changed since the interrupted upload, sending them again\n", dropped)
+		}
+	}
+
+	if j.completed() > 0 {
+		partInfo, err := sftpClient.Stat(partPath)
+		if err != nil {
+			j.reset()
+		} else if dropped, err := verifyPart(client, j, partPath, partInfo.Size(), opts); err != nil {
+			return nil, fmt.Errorf("cannot verify part file: %w", err)
+		} else if dropped > 0 {
+			fmt.Fprintf(os.Stderr, "⚠ %d blocks of %s are damaged, sending them again\n", dropped, partPath)
+		}
+	}
+
+	if done := j.completed(); done > 0 {
+		fmt.Printf("Resuming upload, %d of %d bytes done (%.2f%%)\n", done, fileInfo.Size(), float64(done)/float64(fileInfo.Size())*100)
+		return j, nil
+	}
+
+	part, err := sftpClient.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("cannot create part file: %w", err)
 	}
+	return j, part.Close()
+}
 
-	// delete if exists
-	_ = sftpClient.Remove(remotePath)
-	// Rename .part to actual filename
-	err = sftpClient.Rename(partPath, remotePath)
+// verifyPart forgets the completed blocks that the remote .part file, of
+// size bytes, does not hold. A server with check-file hashes them itself,
+// otherwise they are read back by readBackPart.
+func verifyPart(client *Client, j *journal, partPath string, size int64, opts Options) (int, error) {
+	part, err := client.SFTP().Open(partPath)
 	if err != nil {
-		return fmt.Errorf("failed to rename part file: %w", err)
+		return 0, err
 	}
+	defer part.Close()
 
-	// Verify File
-	fmt.Printf("Verifying integrity...\n")
-	if err := verifyIntegrity(client, localPath, remotePath); err != nil {
-		return fmt.Errorf("integrity check failed: %w", err)
+	end := size
+	if opts.Sparse {
+		end = j.size
 	}
-	fmt.Printf("✓ Integrity check passed\n")
-	return nil
+	data := zeroTail{r: part, size: size, end: end}
+
+	if sums, err := partSums(client, partPath, size/j.blockSize, j.blockSize); err == nil {
+		return j.verifyBlocks(func(r byteRange, _ string) (string, error) {
+			if idx := r.Start / j.blockSize; idx < int64(len(sums)) {
+				return sums[idx], nil
+			}
+			return blockSum(data, r)
+		})
+	}
+	return readBackPart(j, data, size, opts.VerifyResume)
 }
 
-func uploadDir(client *Client, localDir, remoteDir string) error {
-	sftpClient := client.SFTP()
+// readBackPart checks the completed blocks against data, the .part file of
+// size bytes. Reading them all back costs as much as sending them again,
+// so unless full is set only the last block holding data is read, and when
+// it does not match, none is trusted.
+func readBackPart(j *journal, data io.ReaderAt, size int64, full bool) (int, error) {
+	if full {
+		return j.verify(data)
+	}
+
+	last := int64(-1)
+	if idx, ok := j.lastBefore(size); ok {
+		last = j.block(idx).Start
+	}
+	damaged := false
+	dropped, err := j.verifyBlocks(func(r byteRange, recorded string) (string, error) {
+		// past size are holes or missing data, nothing is read
+		if r.Start < size && r.Start != last {
+			return recorded, nil
+		}
+		sum, err := blockSum(data, r)
+		damaged = damaged || r.Start == last && sum != recorded
+		return sum, err
+	})
+	if err != nil || !damaged {
+		return dropped, err
+	}
+
+	dropped += int((j.completed() + j.blockSize - 1) / j.blockSize)
+	j.reset()
+	return dropped, nil
+}
+
+// partSums returns the SHA-256 of the first blocks blocks of path, as
+// check-file computes them on the server.
+func partSums(client *Client, path string, blocks, blockSize int64) ([]string, error) {
+	if _, ok := client.SFTP().HasExtension("check-file"); !ok || blockSize > math.MaxUint32 {
+		return nil, fmt.Errorf("no check-file extension")
+	}
+	if blocks == 0 {
+		return nil, nil
+	}
+
+	algo := hashAlgos["sha256"]
+	raw, err := checkFile(client, path, algo, 0, uint64(blocks*blockSize), uint32(blockSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != int(blocks)*sha256.Size {
+		return nil, fmt.Errorf("check-file: unusable reply")
+	}
+
+	sums := make([]string, blocks)
+	for i := range sums {
+		sums[i] = hex.EncodeToString(raw[i*sha256.Size : (i+1)*sha256.Size])
+	}
+	return sums, nil
+}
+
+func uploadDir(pool *Pool, opts Options, localDir, remoteDir string) error {
 	localDir = filepath.Clean(localDir)
 
-	if err := sftpClient.MkdirAll(remoteDir); err != nil {
+	err := pool.Do(func(client *Client) error {
+		return client.SFTP().MkdirAll(remoteDir)
+	})
+	if err != nil {
 		return fmt.Errorf("cannot create remote directory: %w", err)
 	}
 
-	sem := make(chan struct{}, 4)
+	sem := make(chan struct{}, pool.Size())
 	var wg sync.WaitGroup
 	var ferr error
 	var mu sync.Mutex
+	var dirs dirAttrs
+	var hardlinks hardLinks
 
-	err := filepath.WalkDir(localDir, func(path string, d fs.DirEntry, err error) error {
+	if opts.preserve() {
+		fi, err := os.Stat(localDir)
 		if err != nil {
 			return err
 		}
+		dirs.add(remoteDir, fi)
+	}
 
+	err = walkTree(localTree{}, filepath.ToSlash(localDir), opts, func(path, rel string, fi os.FileInfo) error {
 		mu.Lock()
 		if ferr != nil {
 			mu.Unlock()
@@ -163,16 +329,28 @@ func uploadDir(client *Client, localDir, remoteDir string) error {
 		}
 		mu.Unlock()
 
-		relPath, err := filepath.Rel(localDir, path)
-		if err != nil {
-			return err
+		remotePath := filepath.ToSlash(filepath.Join(remoteDir, rel))
+
+		if link, ok := fi.(linkInfo); ok {
+			return pool.Do(func(client *Client) error {
+				_ = client.SFTP().Remove(remotePath)
+				return client.SFTP().Symlink(link.target, remotePath)
+			})
 		}
 
-		remotePath := filepath.Join(remoteDir, relPath)
-		remotePath = filepath.ToSlash(remotePath)
+		if fi.IsDir() {
+			if opts.preserve() {
+				dirs.add(remotePath, fi)
+			}
+			return pool.Do(func(client *Client) error {
+				return client.SFTP().MkdirAll(remotePath)
+			})
+		}
 
-		if d.IsDir() {
-			return sftpClient.MkdirAll(remotePath)
+		var hl *hardLink
+		var first bool
+		if key, ok := hardLinkKey(fi); ok {
+			hl, first = hardlinks.claim(key, remotePath)
 		}
 
 		wg.Add(1)
@@ -181,14 +359,28 @@ func uploadDir(client *Client, localDir, remoteDir string) error {
 			defer wg.Done()
 			defer func() { <-sem }()
 
-			if err := uploadFile(client, src, dst); err != nil {
+			if hl != nil && !first && hardlinks.link(hl, dst, func(oldname, newname string) error {
+				return pool.Do(func(client *Client) error {
+					return linkRemote(client, oldname, newname)
+				})
+			}) {
+				return
+			}
+
+			err := pool.Do(func(client *Client) error {
+				return uploadFile(client, opts, src, dst)
+			})
+			if first {
+				hl.finish(err)
+			}
+			if err != nil {
 				mu.Lock()
 				if ferr == nil {
 					ferr = err
 				}
 				mu.Unlock()
 			}
-		}(path, remotePath)
+		}(filepath.FromSlash(path), remotePath)
 
 		return nil
 	})
@@ -201,5 +393,13 @@ func uploadDir(client *Client, localDir, remoteDir string) error {
 
 	mu.Lock()
 	defer mu.Unlock()
-	return ferr
+	if ferr != nil {
+		return ferr
+	}
+
+	return dirs.apply(func(path string, fi os.FileInfo) error {
+		return pool.Do(func(client *Client) error {
+			return preserveRemote(client, opts, fi, path)
+		})
+	})
 }
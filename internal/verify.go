@@ -0,0 +1,490 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	VerifyAuto     = "auto"
+	VerifyRemote   = "remote"
+	VerifyReadback = "readback"
+	VerifyNone     = "none"
+)
+
+var (
+	ErrNoRemoteHash = errors.New("server cannot compute the checksum (no SFTP hash extension or hash command); use --verify=readback")
+
+	errNoSession = errors.New("cannot open ssh session")
+)
+
+type hashAlgo struct {
+	name string
+	new  func() hash.Hash
+	// known to the check-file SFTP extension
+	checkFile bool
+	// commands printing the hash of the file %s, tried in order
+	commands []string
+}
+
+var hashAlgos = map[string]hashAlgo{
+	"md5": {"md5", md5.New, true, []string{
+		"md5sum -- %s", "md5 -q -- %s",
+	}},
+	"sha1": {"sha1", sha1.New, true, []string{
+		"sha1sum -- %s", "shasum -a 1 -- %s", "sha1 -q -- %s",
+	}},
+	"sha256": {"sha256", sha256.New, true, []string{
+		"sha256sum -- %s", "shasum -a 256 -- %s", "sha256 -q -- %s",
+	}},
+	"sha512": {"sha512", sha512.New, true, []string{
+		"sha512sum -- %s", "shasum -a 512 -- %s", "sha512 -q -- %s",
+	}},
+	"blake2b": {"blake2b", newBlake2b, false, []string{
+		"b2sum -- %s",
+	}},
+	"xxh64": {"xxh64", func() hash.Hash { return xxhash.New() }, false, []string{
+		"xxh64sum -- %s", "xxhsum -H1 -- %s",
+	}},
+}
+
+// defaultChecksums are tried in order when no algorithm is asked for.
+var defaultChecksums = []string{"sha256", "md5"}
+
+func newBlake2b() hash.Hash {
+	// b2sum prints BLAKE2b-512
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// parseVerifyOptions checks --verify and --checksum.
+func parseVerifyOptions(opts Options) (Options, error) {
+	switch mode := strings.ToLower(opts.Verify); mode {
+	case "":
+		opts.Verify = VerifyAuto
+	case VerifyAuto, VerifyRemote, VerifyReadback, VerifyNone:
+		opts.Verify = mode
+	default:
+		return opts, fmt.Errorf("invalid --verify %q (use auto, remote, readback or none)", opts.Verify)
+	}
+
+	opts.Checksum = strings.ToLower(opts.Checksum)
+	if _, ok := hashAlgos[opts.Checksum]; !ok && opts.Checksum != "" {
+		names := make([]string, 0, len(hashAlgos))
+		for name := range hashAlgos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return opts, fmt.Errorf("invalid --checksum %q (use %s)", opts.Checksum, strings.Join(names, ", "))
+	}
+	return opts, nil
+}
+
+// checksum is how a file is verified: the algorithm, and how the server
+// computes its side. Neither ext nor command means reading the file back.
+type checksum struct {
+	algo    hashAlgo
+	ext     string
+	command string
+	// read back when the server side fails
+	fallback bool
+}
+
+func (c *checksum) method() string {
+	switch {
+	case c.ext != "":
+		return c.ext
+	case c.command != "":
+		return strings.Fields(c.command)[0]
+	default:
+		return "read-back"
+	}
+}
+
+type checksumKey struct {
+	checksum string
+	mode     string
+}
+
+// selectChecksum picks how files are verified on this connection, nil with
+// --verify=none. It is known before the transfer starts, so the local side
+// can be hashed while the data streams through.
+func selectChecksum(client *Client, opts Options) (*checksum, error) {
+	if opts.Verify == VerifyNone {
+		return nil, nil
+	}
+
+	key := checksumKey{opts.Checksum, opts.Verify}
+	if c := client.conn.checksum(key); c != nil {
+		return c, nil
+	}
+
+	names := defaultChecksums
+	if opts.Checksum != "" {
+		names = []string{opts.Checksum}
+	}
+
+	if opts.Verify != VerifyReadback {
+		for _, name := range names {
+			c, err := serverChecksum(client, hashAlgos[name])
+			if errors.Is(err, errNoSession) && opts.Verify == VerifyAuto {
+				// probably out of channels for now, ask again next file
+				return &checksum{algo: hashAlgos[names[0]]}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				c.fallback = opts.Verify == VerifyAuto
+				client.conn.setChecksum(key, c)
+				return c, nil
+			}
+		}
+		if opts.Verify == VerifyRemote {
+			return nil, fmt.Errorf("%s: %w", strings.Join(names, "/"), ErrNoRemoteHash)
+		}
+	}
+
+	c := &checksum{algo: hashAlgos[names[0]]}
+	client.conn.setChecksum(key, c)
+	return c, nil
+}
+
+// serverChecksum finds a way for the server to hash files with algo: an
+// SFTP extension, or a command that hashes /dev/null correctly.
+func serverChecksum(client *Client, algo hashAlgo) (*checksum, error) {
+	if _, ok := client.SFTP().HasExtension("check-file"); ok && algo.checkFile {
+		return &checksum{algo: algo, ext: "check-file"}, nil
+	}
+	if _, ok := client.SFTP().HasExtension("md5-hash"); ok && algo.name == "md5" {
+		return &checksum{algo: algo, ext: "md5-hash"}, nil
+	}
+
+	empty := hex.EncodeToString(algo.new().Sum(nil))
+	for _, command := range algo.commands {
+		sum, err := runHashCommand(client, fmt.Sprintf(command, "/dev/null"), algo)
+		if errors.Is(err, errNoSession) {
+			return nil, err
+		}
+		if err == nil && sum == empty {
+			return &checksum{algo: algo, command: command}, nil
+		}
+	}
+	return nil, nil
+}
+
+// checksum returns the method chosen for key on the connection, so the
+// commands are probed only once.
+func (s *connState) checksum(key checksumKey) *checksum {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checksums[key]
+}
+
+func (s *connState) setChecksum(key checksumKey, c *checksum) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.checksums == nil {
+		s.checksums = make(map[checksumKey]*checksum)
+	}
+	s.checksums[key] = c
+}
+
+// verifyIntegrity compares the local file with the remote one. localSum is
+// the hash computed during the transfer; when empty the local file is read
+// again.
+func verifyIntegrity(client *Client, c *checksum, localPath, remotePath, localSum string) error {
+	if c == nil {
+		return nil
+	}
+
+	fmt.Printf("Verifying integrity...\n")
+	remoteSum, err := c.remoteSum(client, remotePath)
+	if err != nil && c.ext != "" && c.fallback {
+		// an advertised extension that does not work for this algorithm
+		fmt.Fprintf(os.Stderr, "⚠ %v, reading the file back instead\n", err)
+		c = &checksum{algo: c.algo}
+		remoteSum, err = c.remoteSum(client, remotePath)
+	}
+	if err != nil {
+		return fmt.Errorf("integrity check failed: %w", err)
+	}
+
+	if localSum == "" {
+		if localSum, err = fileHash(localPath, c.algo); err != nil {
+			return fmt.Errorf("integrity check failed: %w", err)
+		}
+	}
+	if localSum != remoteSum {
+		return fmt.Errorf("integrity check failed: %s mismatch: local=%s, remote=%s", c.algo.name, localSum, remoteSum)
+	}
+
+	fmt.Printf("✓ Integrity check passed (%s via %s)\n", c.algo.name, c.method())
+	return nil
+}
+
+// verifyJournal compares the SHA-256 the journal took of every block
+// while the data streamed with the check-file hashes of the same blocks of
+// remotePath, so striped transfers need not read the local file again. It
+// reports false when the whole file has to be hashed instead: check-file
+// is not used for sha256, or its reply does not fit.
+func verifyJournal(client *Client, c *checksum, j *journal, remotePath string) (bool, error) {
+	if c == nil || c.ext != "check-file" || c.algo.name != "sha256" || j.blockSize > math.MaxUint32 {
+		return false, nil
+	}
+	local := j.blockSums()
+	if local == nil {
+		return false, nil
+	}
+
+	raw, err := checkFile(client, remotePath, c.algo, 0, 0, uint32(j.blockSize))
+	if err != nil || len(raw) != len(local)*sha256.Size {
+		return false, nil
+	}
+
+	fmt.Printf("Verifying integrity...\n")
+	for idx, sum := range local {
+		remote := hex.EncodeToString(raw[idx*sha256.Size : (idx+1)*sha256.Size])
+		if remote != sum {
+			r := j.block(int64(idx))
+			return true, fmt.Errorf("integrity check failed: sha256 mismatch in bytes %d-%d: local=%s, remote=%s", r.Start, r.End, sum, remote)
+		}
+	}
+
+	fmt.Printf("✓ Integrity check passed (sha256 of %d blocks via check-file)\n", len(local))
+	return true, nil
+}
+
+func (c *checksum) remoteSum(client *Client, path string) (string, error) {
+	switch {
+	case c.ext == "check-file":
+		return checkFileHash(client, path, c.algo)
+	case c.ext == "md5-hash":
+		return md5Hash(client, path)
+	case c.command != "":
+		return runHashCommand(client, fmt.Sprintf(c.command, shellQuote(path)), c.algo)
+	default:
+		return readbackHash(client, path, c.algo)
+	}
+}
+
+func checkFileHash(client *Client, path string, algo hashAlgo) (string, error) {
+	sum, err := checkFile(client, path, algo, 0, 0, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(sum) != algo.new().Size() {
+		return "", fmt.Errorf("check-file: unusable reply")
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// checkFile asks the server for the hashes of length bytes of path from
+// off (0: to the end), one for every blockSize bytes (0: a single hash
+// for the whole range), back to back.
+func checkFile(client *Client, path string, algo hashAlgo, off, length uint64, blockSize uint32) ([]byte, error) {
+	ext, err := client.ext()
+	if err != nil {
+		return nil, err
+	}
+
+	// name, algorithm list, start offset, length, block size
+	payload := appendString(nil, path)
+	payload = appendString(payload, algo.name)
+	payload = binary.BigEndian.AppendUint64(payload, off)
+	payload = binary.BigEndian.AppendUint64(payload, length)
+	payload = binary.BigEndian.AppendUint32(payload, blockSize)
+
+	reply, err := ext.extended("check-file-name", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	_, reply, err = readString(reply)
+	if err != nil {
+		return nil, err
+	}
+	name, sums, err := readString(reply)
+	if err != nil {
+		return nil, err
+	}
+	if name != algo.name {
+		return nil, fmt.Errorf("check-file: unusable reply (%s)", name)
+	}
+	return sums, nil
+}
+
+func md5Hash(client *Client, path string) (string, error) {
+	ext, err := client.ext()
+	if err != nil {
+		return "", err
+	}
+
+	// name, start offset, length, quick check hash (empty: none)
+	payload := appendString(nil, path)
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+	payload = appendString(payload, "")
+
+	reply, err := ext.extended("md5-hash", payload)
+	if err != nil {
+		return "", err
+	}
+	sum, _, err := readString(reply)
+	if err != nil || len(sum) != md5.Size {
+		return "", fmt.Errorf("md5-hash: malformed reply")
+	}
+	return hex.EncodeToString([]byte(sum)), nil
+}
+
+func runHashCommand(client *Client, command string, algo hashAlgo) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errNoSession, err)
+	}
+	defer session.Close()
+
+	output, err := session.Output(command)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", strings.Fields(command)[0], err)
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) < 1 {
+		return "", fmt.Errorf("unexpected output: %s", string(output))
+	}
+	// GNU coreutils escapes the line of names with special characters
+	sum := strings.ToLower(strings.TrimPrefix(fields[0], "\\"))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2*algo.new().Size() {
+		return "", fmt.Errorf("unexpected output: %s", string(output))
+	}
+	return sum, nil
+}
+
+// readbackHash reads the remote file back over SFTP and hashes it locally.
+func readbackHash(client *Client, path string, algo hashAlgo) (string, error) {
+	f, err := client.SFTP().Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := algo.new()
+	if _, err := f.WriteTo(h); err != nil {
+		return "", fmt.Errorf("read back failed: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// inlineHash hashes a file in order as its data passes through Chunker.
+// Ranges the stream skips, blocks completed before a resume, are read from
+// src instead. The resume already read those blocks to check them against
+// the journal, so they are read twice; the rest of the file is read once.
+type inlineHash struct {
+	h    hash.Hash
+	src  io.ReaderAt
+	size int64
+
+	mu   sync.Mutex
+	next int64
+	err  error
+}
+
+func newInlineHash(algo hashAlgo, src io.ReaderAt, size int64) *inlineHash {
+	return &inlineHash{h: algo.new(), src: src, size: size}
+}
+
+// tee returns a reader that hashes what it reads from r, which starts at
+// offset off of the file.
+func (ih *inlineHash) tee(r io.Reader, off int64) io.Reader {
+	return &inlineReader{ih: ih, r: r, off: off}
+}
+
+func (ih *inlineHash) write(off int64, p []byte) {
+	ih.mu.Lock()
+	defer ih.mu.Unlock()
+
+	if ih.err != nil {
+		return
+	}
+	if off > ih.next {
+		ih.fill(off)
+	}
+	if end := off + int64(len(p)); ih.err == nil && off <= ih.next && end > ih.next {
+		ih.h.Write(p[ih.next-off:])
+		ih.next = end
+	}
+}
+
+func (ih *inlineHash) fill(to int64) {
+	n, err := io.Copy(ih.h, io.NewSectionReader(ih.src, ih.next, to-ih.next))
+	ih.next += n
+	if err == nil && ih.next < to {
+		err = io.ErrUnexpectedEOF
+	}
+	ih.err = err
+}
+
+// sum hashes the rest of the file and returns the digest.
+func (ih *inlineHash) sum() (string, error) {
+	ih.mu.Lock()
+	defer ih.mu.Unlock()
+
+	if ih.err == nil && ih.next < ih.size {
+		ih.fill(ih.size)
+	}
+	if ih.err != nil {
+		return "", ih.err
+	}
+	return hex.EncodeToString(ih.h.Sum(nil)), nil
+}
+
+type inlineReader struct {
+	ih  *inlineHash
+	r   io.Reader
+	off int64
+}
+
+func (ir *inlineReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.ih.write(ir.off, p[:n])
+		ir.off += int64(n)
+	}
+	return n, err
+}
+
+func fileHash(path string, algo hashAlgo) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := algo.new()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}